@@ -0,0 +1,167 @@
+package retry
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultAdaptiveWindow is the number of observations an AdaptiveBackOff keeps when `Window` is zero
+const DefaultAdaptiveWindow = 100
+
+func Adaptive(percentile float64, min, max time.Duration) *AdaptiveBackOff {
+	return &AdaptiveBackOff{Percentile: percentile, Min: min, Max: max}
+}
+
+// Retry sleeping for roughly as long as a typical successful attempt takes. The interval is
+// the `Percentile` of the most recent `Window` latencies recorded via `Observe()` bounded by
+// `Min` and `Max`. Until the first latency is observed the interval is `Min`. A `Max` of zero
+// leaves the interval unbounded and an `Attempts` of zero retries until the context is cancelled.
+//
+// Back offs returned by `New()` share their observations with the original, such that a
+// single AdaptiveBackOff can be used by many concurrent calls to `Until()`.
+//
+//	backOff := retry.Adaptive(0.95, 10*time.Millisecond, 5*time.Second)
+//	err := retry.Until(ctx, backOff, func(ctx context.Context, att int) error {
+//		start := time.Now()
+//		if err := call(ctx); err != nil {
+//			return err
+//		}
+//		backOff.Observe(time.Since(start))
+//		return nil
+//	})
+type AdaptiveBackOff struct {
+	Min, Max time.Duration
+	// Percentile of the observed latencies used as the interval, between 0 and 1
+	Percentile float64
+	Attempts   int64
+	// Window is the number of most recent observations kept, defaults to `DefaultAdaptiveWindow`
+	Window  int
+	retries int64
+	once    sync.Once
+	window  *latencyWindow
+}
+
+func (b *AdaptiveBackOff) NumRetries() int { return int(atomic.LoadInt64(&b.retries)) }
+func (b *AdaptiveBackOff) Reset()          { atomic.StoreInt64(&b.retries, 0) }
+func (b *AdaptiveBackOff) Next() (time.Duration, bool) {
+	retries := atomic.AddInt64(&b.retries, 1)
+	interval := b.Interval()
+	if b.Attempts != 0 && retries >= b.Attempts {
+		return interval, false
+	}
+	return interval, true
+}
+func (b *AdaptiveBackOff) New() BackOff {
+	return &AdaptiveBackOff{
+		retries:    atomic.LoadInt64(&b.retries),
+		Min:        b.Min,
+		Max:        b.Max,
+		Percentile: b.Percentile,
+		Attempts:   b.Attempts,
+		Window:     b.Window,
+		window:     b.latencies(),
+	}
+}
+
+// Observe records the latency of a successful attempt
+func (b *AdaptiveBackOff) Observe(d time.Duration) {
+	b.latencies().add(d)
+}
+
+// Interval returns the interval the back off currently sleeps between retries
+func (b *AdaptiveBackOff) Interval() time.Duration {
+	d, ok := b.latencies().percentile(b.Percentile)
+	if !ok || d < b.Min {
+		return b.Min
+	}
+	if b.Max != 0 && d > b.Max {
+		return b.Max
+	}
+	return d
+}
+
+func (b *AdaptiveBackOff) Validate() error {
+	switch {
+	case b.Min < 0:
+		return errors.Wrapf(ErrMisconfigured, "negative Min '%s'", b.Min)
+	case b.Max != 0 && b.Max < b.Min:
+		return errors.Wrapf(ErrMisconfigured, "Max '%s' is less than Min '%s'", b.Max, b.Min)
+	case b.Percentile < 0 || b.Percentile > 1:
+		return errors.Wrapf(ErrMisconfigured, "Percentile '%v' must be between 0 and 1", b.Percentile)
+	case b.Attempts < 0:
+		return errors.Wrapf(ErrMisconfigured, "negative Attempts '%d'", b.Attempts)
+	case b.Window < 0:
+		return errors.Wrapf(ErrMisconfigured, "negative Window '%d'", b.Window)
+	}
+	return nil
+}
+
+// MaxTotalDuration returns the longest time the back off could sleep in total before it
+// stops retrying. Returns false if either `Attempts` or `Max` is unbounded.
+func (b *AdaptiveBackOff) MaxTotalDuration() (time.Duration, bool) {
+	if b.Attempts == 0 || b.Max == 0 {
+		return 0, false
+	}
+	if b.Attempts <= 1 {
+		return 0, true
+	}
+	return mulDuration(b.Max, b.Attempts-1), true
+}
+
+func (b *AdaptiveBackOff) latencies() *latencyWindow {
+	b.once.Do(func() {
+		if b.window == nil {
+			size := b.Window
+			if size <= 0 {
+				size = DefaultAdaptiveWindow
+			}
+			b.window = &latencyWindow{samples: make([]time.Duration, 0, size)}
+		}
+	})
+	return b.window
+}
+
+// latencyWindow is a ring buffer of the most recent observed latencies
+type latencyWindow struct {
+	mutex   sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if len(w.samples) < cap(w.samples) {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % len(w.samples)
+}
+
+// percentile returns the nearest rank percentile `p` of the samples in the window
+func (w *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	w.mutex.Lock()
+	sorted := make([]time.Duration, len(w.samples))
+	copy(sorted, w.samples)
+	w.mutex.Unlock()
+
+	if len(sorted) == 0 {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank], true
+}
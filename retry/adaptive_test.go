@@ -0,0 +1,116 @@
+package retry_test
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/mailgun/holster/v3/retry"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdaptivePercentile(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		percentile float64
+		latencies  func(i int) time.Duration
+		expected   time.Duration
+	}{
+		{
+			name:       "uniform p50",
+			percentile: 0.5,
+			latencies:  func(i int) time.Duration { return time.Duration(i+1) * time.Millisecond },
+			expected:   50 * time.Millisecond,
+		},
+		{
+			name:       "uniform p95",
+			percentile: 0.95,
+			latencies:  func(i int) time.Duration { return time.Duration(i+1) * time.Millisecond },
+			expected:   95 * time.Millisecond,
+		},
+		{
+			name:       "long tail p90 ignores the outliers",
+			percentile: 0.9,
+			latencies: func(i int) time.Duration {
+				if i%20 == 0 {
+					return 10 * time.Second
+				}
+				return 20 * time.Millisecond
+			},
+			expected: 20 * time.Millisecond,
+		},
+		{
+			name:       "bounded by max",
+			percentile: 1,
+			latencies:  func(i int) time.Duration { return 10 * time.Second },
+			expected:   time.Second,
+		},
+		{
+			name:       "bounded by min",
+			percentile: 0.5,
+			latencies:  func(i int) time.Duration { return time.Microsecond },
+			expected:   time.Millisecond,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			backOff := retry.Adaptive(tt.percentile, time.Millisecond, time.Second)
+
+			// Feed the latencies out of order, the percentile must not depend on the order observed
+			for _, i := range rand.New(rand.NewSource(1)).Perm(100) {
+				backOff.Observe(tt.latencies(i))
+			}
+			interval, retry := backOff.Next()
+			assert.True(t, retry)
+			assert.Equal(t, tt.expected, interval)
+		})
+	}
+}
+
+func TestAdaptiveTracksRecentLatencies(t *testing.T) {
+	backOff := &retry.AdaptiveBackOff{Percentile: 0.5, Min: time.Millisecond, Window: 10}
+
+	// Before anything is observed the back off uses Min
+	interval, _ := backOff.Next()
+	assert.Equal(t, time.Millisecond, interval)
+
+	for i := 0; i < 10; i++ {
+		backOff.Observe(100 * time.Millisecond)
+	}
+	assert.Equal(t, 100*time.Millisecond, backOff.Interval())
+
+	// Once the window is full only the most recent latencies count
+	for i := 0; i < 10; i++ {
+		backOff.Observe(10 * time.Millisecond)
+	}
+	assert.Equal(t, 10*time.Millisecond, backOff.Interval())
+}
+
+func TestAdaptiveUntil(t *testing.T) {
+	backOff := &retry.AdaptiveBackOff{Percentile: 0.9, Min: time.Millisecond, Max: time.Second, Attempts: 3}
+	for i := 0; i < 10; i++ {
+		backOff.Observe(5 * time.Millisecond)
+	}
+
+	// Copies used by Until share the observations of the original
+	rec, bo := retry.RecordIntervals(backOff)
+	err := retry.Until(context.Background(), bo, func(ctx context.Context, att int) error {
+		return errCause
+	})
+	require.Error(t, err)
+	assert.Equal(t, []time.Duration{5 * time.Millisecond, 5 * time.Millisecond}, rec.Intervals())
+
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, retry.AttemptsExhausted, retryErr.Reason)
+	assert.Equal(t, 3, retryErr.Attempts)
+
+	// Observations made through a copy are visible to the original
+	copied := backOff.New().(*retry.AdaptiveBackOff)
+	for i := 0; i < 10; i++ {
+		copied.Observe(50 * time.Millisecond)
+	}
+	assert.Equal(t, 50*time.Millisecond, backOff.Interval())
+}
@@ -2,8 +2,11 @@ package retry
 
 import (
 	"math"
+	"math/rand"
 	"sync/atomic"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 type BackOff interface {
@@ -36,6 +39,16 @@ func (b *ConstBackOff) New() BackOff {
 	}
 }
 
+func (b *ConstBackOff) Validate() error {
+	if b.Interval < 0 {
+		return errors.Wrapf(ErrMisconfigured, "negative Interval '%s'", b.Interval)
+	}
+	return nil
+}
+
+// MaxTotalDuration always returns false as the back off retries indefinitely
+func (b *ConstBackOff) MaxTotalDuration() (time.Duration, bool) { return 0, false }
+
 func Attempts(a int, t time.Duration) *AttemptsBackOff {
 	return &AttemptsBackOff{Interval: t, Attempts: int64(a)}
 }
@@ -64,40 +77,403 @@ func (b *AttemptsBackOff) New() BackOff {
 	}
 }
 
+func (b *AttemptsBackOff) Validate() error {
+	if b.Interval < 0 {
+		return errors.Wrapf(ErrMisconfigured, "negative Interval '%s'", b.Interval)
+	}
+	if b.Attempts < 0 {
+		return errors.Wrapf(ErrMisconfigured, "negative Attempts '%d'", b.Attempts)
+	}
+	return nil
+}
+
+// MaxTotalDuration returns the total time the back off sleeps before it stops retrying
+func (b *AttemptsBackOff) MaxTotalDuration() (time.Duration, bool) {
+	if b.Attempts <= 1 {
+		return 0, true
+	}
+	return mulDuration(b.Interval, b.Attempts-1), true
+}
+
+// DefaultExponential returns a new exponential back off with sane defaults for most uses. It
+// starts with a Min of 100ms doubling to a Max of 30s with a Jitter of 0.2 and retries until
+// the context is cancelled. Each call returns a new independent back off.
+func DefaultExponential() *ExponentialBackOff {
+	return &ExponentialBackOff{
+		Min:    100 * time.Millisecond,
+		Max:    30 * time.Second,
+		Factor: 2,
+		Jitter: 0.2,
+	}
+}
+
+// Retry with an exponentially increasing interval between each retry. The interval
+// slept after the Nth failed attempt is `Min * Factor^N` bounded by `Min` and `Max`, such
+// that with a `Factor` of 2 the first sleep is `Min * 2`. If both `Attempts` and `MaxElapsed`
+// are non zero the retry stops on whichever limit is reached first. If neither is set the
+// retry continues until the context is cancelled.
 type ExponentialBackOff struct {
 	Min, Max time.Duration
 	Factor   float64
 	Attempts int64
-	retries  int64
+	// MaxElapsed is the total amount of time allowed since the first call
+	// to `Next()` after which the back off reports it is done retrying
+	MaxElapsed time.Duration
+	// Jitter randomly adjusts each interval by up to +/- `Jitter * interval`, the
+	// adjusted interval is still bounded by `Min` and `Max`. Zero disables jitter.
+	Jitter float64
+	// FirstInterval if not zero is slept after the first failed attempt instead of `Min * Factor`,
+	// without jitter or bounds. The intervals after the second and later attempts are unchanged,
+	// which allows a quick first retry followed by the usual progression.
+	FirstInterval time.Duration
+	// Clock if provided is the source of time for `MaxElapsed`, defaults to the real clock.
+	// Set it to the clock given to `retry.WithClock()` when using a `FakeClock`.
+	Clock   Clock
+	retries int64
+	started int64
+	expired int32
 }
 
 func (b *ExponentialBackOff) NumRetries() int { return int(atomic.LoadInt64(&b.retries)) }
-func (b *ExponentialBackOff) Reset()          { atomic.StoreInt64(&b.retries, 0) }
+func (b *ExponentialBackOff) Reset() {
+	atomic.StoreInt64(&b.retries, 0)
+	atomic.StoreInt64(&b.started, 0)
+	atomic.StoreInt32(&b.expired, 0)
+}
 func (b *ExponentialBackOff) Next() (time.Duration, bool) {
 	retries := atomic.AddInt64(&b.retries, 1)
 	interval := b.nextInterval(retries)
 	if b.Attempts != 0 && retries > b.Attempts {
 		return interval, false
 	}
+	if b.MaxElapsed != 0 {
+		now := nowFrom(b.Clock).UnixNano()
+		atomic.CompareAndSwapInt64(&b.started, 0, now)
+		if time.Duration(now-atomic.LoadInt64(&b.started)) >= b.MaxElapsed {
+			atomic.StoreInt32(&b.expired, 1)
+			return interval, false
+		}
+	}
 	return interval, true
 }
 func (b *ExponentialBackOff) New() BackOff {
 	return &ExponentialBackOff{
-		retries:  atomic.LoadInt64(&b.retries),
-		Attempts: b.Attempts,
-		Factor:   b.Factor,
-		Min:      b.Min,
-		Max:      b.Max,
+		retries:       atomic.LoadInt64(&b.retries),
+		Attempts:      b.Attempts,
+		Factor:        b.Factor,
+		Min:           b.Min,
+		Max:           b.Max,
+		MaxElapsed:    b.MaxElapsed,
+		Jitter:        b.Jitter,
+		FirstInterval: b.FirstInterval,
+		Clock:         b.Clock,
 	}
 }
 
+// Resume advances the back off as if it had already retried `retries` times, such that the
+// next interval is the one that would follow those retries. This allows a worker which
+// restarts to continue backing off from where a previous run left off instead of starting
+// over at `Min`, persisting the number of retries via `NumRetries()` is up to the caller.
+// The resumed retries count towards `Attempts`.
+func (b *ExponentialBackOff) Resume(retries int) {
+	atomic.StoreInt64(&b.retries, int64(retries))
+}
+
+// Validate returns an error wrapping `ErrMisconfigured` if the back off would retry
+// without sleeping or the intervals are nonsensical
+func (b *ExponentialBackOff) Validate() error {
+	switch {
+	case b.Min <= 0:
+		return errors.Wrapf(ErrMisconfigured, "Min '%s' must be greater than zero", b.Min)
+	case b.Max < b.Min:
+		return errors.Wrapf(ErrMisconfigured, "Max '%s' is less than Min '%s'", b.Max, b.Min)
+	case b.Factor <= 0:
+		return errors.Wrapf(ErrMisconfigured, "Factor '%v' must be greater than zero", b.Factor)
+	case b.Attempts < 0:
+		return errors.Wrapf(ErrMisconfigured, "negative Attempts '%d'", b.Attempts)
+	case b.MaxElapsed < 0:
+		return errors.Wrapf(ErrMisconfigured, "negative MaxElapsed '%s'", b.MaxElapsed)
+	case b.Jitter < 0 || b.Jitter > 1:
+		return errors.Wrapf(ErrMisconfigured, "Jitter '%v' must be between 0 and 1", b.Jitter)
+	case b.FirstInterval < 0:
+		return errors.Wrapf(ErrMisconfigured, "negative FirstInterval '%s'", b.FirstInterval)
+	}
+	return nil
+}
+
+// Expired returns true if the back off stopped retrying because `MaxElapsed` was reached
+func (b *ExponentialBackOff) Expired() bool { return atomic.LoadInt32(&b.expired) == 1 }
+
 func (b *ExponentialBackOff) nextInterval(retries int64) time.Duration {
-	d := time.Duration(float64(b.Min) * math.Pow(b.Factor, float64(retries)))
-	if d > b.Max {
+	if retries == 1 && b.FirstInterval != 0 {
+		return b.FirstInterval
+	}
+	d := float64(b.Min) * math.Pow(b.Factor, float64(retries))
+	if b.Jitter != 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	return b.bound(d)
+}
+
+// maxInterval returns the longest interval the back off could return for `retries` including any jitter
+func (b *ExponentialBackOff) maxInterval(retries int64) time.Duration {
+	if retries == 1 && b.FirstInterval != 0 {
+		return b.FirstInterval
+	}
+	return b.bound(float64(b.Min) * math.Pow(b.Factor, float64(retries)) * (1 + b.Jitter))
+}
+
+func (b *ExponentialBackOff) bound(d float64) time.Duration {
+	// Compare before converting to a duration, on long running retries the result
+	// overflows an int64 and the conversion of an overflowed float is undefined
+	if d > float64(b.Max) {
 		return b.Max
 	}
-	if d < b.Min {
+	if math.IsNaN(d) || d < float64(b.Min) {
 		return b.Min
 	}
-	return d
+	return time.Duration(d)
+}
+
+// MaxTotalDuration returns the longest time the back off could sleep in total, including
+// any jitter, before it stops retrying. Returns false if the back off is unbounded.
+func (b *ExponentialBackOff) MaxTotalDuration() (time.Duration, bool) {
+	if b.Attempts == 0 && b.MaxElapsed == 0 {
+		return 0, false
+	}
+
+	var total time.Duration
+	if b.Attempts != 0 {
+		for r := int64(1); r <= b.Attempts; r++ {
+			d := b.maxInterval(r)
+			// Once we reach Max all the remaining intervals are Max
+			if d == b.Max && (r > 1 || b.FirstInterval == 0) {
+				total = addDuration(total, mulDuration(b.Max, b.Attempts-r+1))
+				break
+			}
+			total = addDuration(total, d)
+		}
+	}
+
+	// The last sleep may start just before MaxElapsed is reached
+	if b.MaxElapsed != 0 {
+		longest := b.Max
+		if b.FirstInterval > longest {
+			longest = b.FirstInterval
+		}
+		elapsed := addDuration(b.MaxElapsed, longest)
+		if b.Attempts == 0 || elapsed < total {
+			total = elapsed
+		}
+	}
+	return total, true
+}
+
+func SpreadUntil(deadline time.Time, attempts int) *SpreadBackOff {
+	return &SpreadBackOff{Deadline: deadline, Attempts: int64(attempts)}
+}
+
+// Retry up to `Attempts` times spreading the retries evenly over the time remaining
+// until `Deadline`. Each interval is the time remaining divided by the number of retries
+// remaining plus one, such that the last attempt is made one interval before the deadline
+// instead of racing a context which expires at the same deadline. This adapts the schedule
+// to the time taken by each attempt. The back off stops retrying
+// once the attempts are exhausted or the deadline has passed.
+type SpreadBackOff struct {
+	Deadline time.Time
+	Attempts int64
+	// Clock if provided is the source of time compared to `Deadline`, defaults to the real clock.
+	// Set it to the clock given to `retry.WithClock()` when using a `FakeClock`.
+	Clock   Clock
+	retries int64
+	expired int32
+}
+
+func (b *SpreadBackOff) NumRetries() int { return int(atomic.LoadInt64(&b.retries)) }
+func (b *SpreadBackOff) Reset() {
+	atomic.StoreInt64(&b.retries, 0)
+	atomic.StoreInt32(&b.expired, 0)
+}
+func (b *SpreadBackOff) Next() (time.Duration, bool) {
+	retries := atomic.AddInt64(&b.retries, 1)
+	if retries >= b.Attempts {
+		return 0, false
+	}
+	remaining := b.Deadline.Sub(nowFrom(b.Clock))
+	if remaining <= 0 {
+		atomic.StoreInt32(&b.expired, 1)
+		return 0, false
+	}
+	return remaining / time.Duration(b.Attempts-retries+1), true
+}
+func (b *SpreadBackOff) New() BackOff {
+	return &SpreadBackOff{
+		retries:  atomic.LoadInt64(&b.retries),
+		Deadline: b.Deadline,
+		Attempts: b.Attempts,
+		Clock:    b.Clock,
+	}
+}
+
+// Expired returns true if the back off stopped retrying because the `Deadline` passed
+func (b *SpreadBackOff) Expired() bool { return atomic.LoadInt32(&b.expired) == 1 }
+
+func (b *SpreadBackOff) Validate() error {
+	if b.Attempts < 0 {
+		return errors.Wrapf(ErrMisconfigured, "negative Attempts '%d'", b.Attempts)
+	}
+	return nil
+}
+
+// MaxTotalDuration returns the time remaining until the `Deadline`
+func (b *SpreadBackOff) MaxTotalDuration() (time.Duration, bool) {
+	if d := b.Deadline.Sub(nowFrom(b.Clock)); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+func RateLimited(qps float64) *RateLimitedBackOff {
+	return &RateLimitedBackOff{QPS: qps}
+}
+
+// Retry indefinitely at an average rate of `QPS` retries per second. Each interval is chosen
+// uniformly between zero and `2/QPS` such that the mean interval is `1/QPS`, the full jitter
+// spreads the retries of many callers without any coordination between them. This limits the
+// retry rate of a single retry, it is not a limit shared across retries or processes.
+type RateLimitedBackOff struct {
+	QPS float64
+	// Rand if provided is the source of the jitter, defaults to the global source of the math/rand
+	// package. A `rand.Rand` is not safe for concurrent use and is shared by copies made via `New()`.
+	Rand    *rand.Rand
+	retries int64
+}
+
+func (b *RateLimitedBackOff) NumRetries() int { return int(atomic.LoadInt64(&b.retries)) }
+func (b *RateLimitedBackOff) Reset()          { atomic.StoreInt64(&b.retries, 0) }
+func (b *RateLimitedBackOff) Next() (time.Duration, bool) {
+	atomic.AddInt64(&b.retries, 1)
+	f := rand.Float64
+	if b.Rand != nil {
+		f = b.Rand.Float64
+	}
+	return time.Duration(f() * 2 * float64(time.Second) / b.QPS), true
+}
+func (b *RateLimitedBackOff) New() BackOff {
+	return &RateLimitedBackOff{
+		retries: atomic.LoadInt64(&b.retries),
+		QPS:     b.QPS,
+		Rand:    b.Rand,
+	}
+}
+
+func (b *RateLimitedBackOff) Validate() error {
+	if !(b.QPS > 0) || math.IsInf(b.QPS, 1) {
+		return errors.Wrapf(ErrMisconfigured, "QPS '%v' must be greater than zero", b.QPS)
+	}
+	return nil
+}
+
+// MaxTotalDuration always returns false as the back off retries indefinitely
+func (b *RateLimitedBackOff) MaxTotalDuration() (time.Duration, bool) { return 0, false }
+
+func Sequence(first, then BackOff) *SequenceBackOff {
+	return &SequenceBackOff{First: first, Then: then}
+}
+
+// Retry using the `First` back off until it is exhausted, then continue retrying using the
+// `Then` back off. The number of retries is counted continuously across both back offs.
+type SequenceBackOff struct {
+	First, Then BackOff
+	retries     int64
+	switched    int32
+}
+
+func (b *SequenceBackOff) NumRetries() int { return int(atomic.LoadInt64(&b.retries)) }
+func (b *SequenceBackOff) Reset() {
+	atomic.StoreInt64(&b.retries, 0)
+	atomic.StoreInt32(&b.switched, 0)
+	b.First.Reset()
+	b.Then.Reset()
+}
+func (b *SequenceBackOff) Next() (time.Duration, bool) {
+	atomic.AddInt64(&b.retries, 1)
+	if atomic.LoadInt32(&b.switched) == 0 {
+		if interval, retry := b.First.Next(); retry {
+			return interval, true
+		}
+		atomic.StoreInt32(&b.switched, 1)
+	}
+	return b.Then.Next()
+}
+func (b *SequenceBackOff) New() BackOff {
+	first, then := b.First.New(), b.Then.New()
+	first.Reset()
+	then.Reset()
+	return &SequenceBackOff{First: first, Then: then}
+}
+
+// Expired returns true if the `Then` back off stopped retrying because of a time limit
+func (b *SequenceBackOff) Expired() bool {
+	if e, ok := b.Then.(expirer); ok && atomic.LoadInt32(&b.switched) == 1 {
+		return e.Expired()
+	}
+	return false
+}
+
+func (b *SequenceBackOff) Validate() error {
+	switch {
+	case b.First == nil:
+		return errors.Wrap(ErrMisconfigured, "First back off is nil")
+	case b.Then == nil:
+		return errors.Wrap(ErrMisconfigured, "Then back off is nil")
+	}
+	for _, bo := range []BackOff{b.First, b.Then} {
+		if v, ok := bo.(validator); ok {
+			if err := v.Validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MaxTotalDuration returns the sum of the durations of both back offs, returns
+// false if either back off is unbounded or does not report a duration
+func (b *SequenceBackOff) MaxTotalDuration() (time.Duration, bool) {
+	first, ok := MaxTotalDuration(b.First)
+	if !ok {
+		return 0, false
+	}
+	then, ok := MaxTotalDuration(b.Then)
+	if !ok {
+		return 0, false
+	}
+	return addDuration(first, then), true
+}
+
+// MaxTotalDuration returns the longest time the back off could sleep in total before
+// it stops retrying. Returns false if the back off is unbounded or does not provide
+// a `MaxTotalDuration()` method.
+func MaxTotalDuration(b BackOff) (time.Duration, bool) {
+	if d, ok := b.(interface {
+		MaxTotalDuration() (time.Duration, bool)
+	}); ok {
+		return d.MaxTotalDuration()
+	}
+	return 0, false
+}
+
+func addDuration(a, b time.Duration) time.Duration {
+	if a > math.MaxInt64-b {
+		return math.MaxInt64
+	}
+	return a + b
+}
+
+func mulDuration(d time.Duration, n int64) time.Duration {
+	if d != 0 && n > math.MaxInt64/int64(d) {
+		return math.MaxInt64
+	}
+	return d * time.Duration(n)
 }
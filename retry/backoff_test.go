@@ -0,0 +1,575 @@
+package retry_test
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/mailgun/holster/v3/retry"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSequence(t *testing.T) {
+	rec, backOff := retry.RecordIntervals(retry.Sequence(
+		&retry.ExponentialBackOff{
+			Min:      time.Millisecond,
+			Max:      time.Millisecond * 100,
+			Factor:   2,
+			Attempts: 3,
+		},
+		retry.Attempts(3, time.Millisecond*10),
+	))
+
+	var attempts []int
+	err := retry.Until(context.Background(), backOff, func(ctx context.Context, att int) error {
+		attempts = append(attempts, att)
+		return errCause
+	})
+	require.Error(t, err)
+
+	// Exponential for 3 retries, then hand off to the constant interval until it exhausts
+	assert.Equal(t, []time.Duration{
+		time.Millisecond * 2,
+		time.Millisecond * 4,
+		time.Millisecond * 8,
+		time.Millisecond * 10,
+		time.Millisecond * 10,
+	}, rec.Intervals())
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6}, attempts)
+	assert.Equal(t, 6, backOff.NumRetries())
+}
+
+func TestSequenceNew(t *testing.T) {
+	backOff := retry.Sequence(retry.Attempts(2, time.Millisecond), retry.Interval(time.Millisecond*10))
+	for i := 0; i < 3; i++ {
+		backOff.Next()
+	}
+	assert.Equal(t, 3, backOff.NumRetries())
+
+	// New() resets both children so the sequence starts over
+	bo := backOff.New()
+	assert.Equal(t, 0, bo.NumRetries())
+	interval, retry := bo.Next()
+	assert.True(t, retry)
+	assert.Equal(t, time.Millisecond, interval)
+
+	// Reset() starts the sequence over
+	backOff.Reset()
+	interval, _ = backOff.Next()
+	assert.Equal(t, time.Millisecond, interval)
+}
+
+func TestExponentialLongRunning(t *testing.T) {
+	backOff := &retry.ExponentialBackOff{
+		Min:    time.Millisecond,
+		Max:    time.Minute,
+		Factor: 2,
+	}
+
+	// Run enough retries that Min * Factor^N overflows a time.Duration
+	for i := 1; i <= 100000; i++ {
+		interval, retry := backOff.Next()
+		require.True(t, retry)
+		if i > 20 {
+			require.Equal(t, time.Minute, interval, "on retry %d", i)
+		}
+	}
+	assert.Equal(t, 100000, backOff.NumRetries())
+}
+
+func TestMisconfigured(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		backOff retry.BackOff
+		msg     string
+	}{
+		{
+			name:    "negative interval",
+			backOff: retry.Interval(-time.Second),
+			msg:     "negative Interval '-1s'",
+		},
+		{
+			name:    "negative attempts",
+			backOff: retry.Attempts(-1, time.Second),
+			msg:     "negative Attempts '-1'",
+		},
+		{
+			name:    "zero min",
+			backOff: &retry.ExponentialBackOff{Max: time.Second, Factor: 2},
+			msg:     "Min '0s' must be greater than zero",
+		},
+		{
+			name:    "min greater than max",
+			backOff: &retry.ExponentialBackOff{Min: time.Second, Max: time.Millisecond, Factor: 2},
+			msg:     "Max '1ms' is less than Min '1s'",
+		},
+		{
+			name:    "zero factor",
+			backOff: &retry.ExponentialBackOff{Min: time.Millisecond, Max: time.Second},
+			msg:     "Factor '0' must be greater than zero",
+		},
+		{
+			name:    "adaptive percentile",
+			backOff: retry.Adaptive(95, time.Millisecond, time.Second),
+			msg:     "Percentile '95' must be between 0 and 1",
+		},
+		{
+			name:    "zero qps",
+			backOff: retry.RateLimited(0),
+			msg:     "QPS '0' must be greater than zero",
+		},
+		{
+			name:    "sequence",
+			backOff: retry.Sequence(retry.Attempts(2, time.Millisecond), retry.Interval(-time.Second)),
+			msg:     "negative Interval '-1s'",
+		},
+		{
+			name:    "sequence nil first",
+			backOff: retry.Sequence(nil, retry.Attempts(2, time.Millisecond)),
+			msg:     "First back off is nil",
+		},
+		{
+			name:    "sequence nil then",
+			backOff: retry.Sequence(retry.Attempts(2, time.Millisecond), nil),
+			msg:     "Then back off is nil",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var called bool
+			err := retry.Until(context.Background(), tt.backOff, func(ctx context.Context, att int) error {
+				called = true
+				return nil
+			})
+
+			require.Error(t, err)
+			assert.False(t, called)
+			assert.True(t, errors.Is(err, retry.ErrMisconfigured))
+
+			var retryErr *retry.Err
+			require.True(t, errors.As(err, &retryErr))
+			assert.Equal(t, retry.Misconfigured, retryErr.Reason)
+			assert.Equal(t, 0, retryErr.Attempts)
+			assert.Equal(t, "on attempt '0'; misconfigured: "+tt.msg+": misconfigured back off", err.Error())
+		})
+	}
+}
+
+func TestMisconfiguredNil(t *testing.T) {
+	ctx := context.Background()
+	noop := func(ctx context.Context, att int) error { return nil }
+
+	for _, tt := range []struct {
+		name string
+		run  func() error
+		msg  string
+	}{
+		{
+			name: "nil back off",
+			run:  func() error { return retry.Until(ctx, nil, noop) },
+			msg:  "back off is nil",
+		},
+		{
+			name: "nil func",
+			run:  func() error { return retry.Until(ctx, retry.Attempts(2, time.Millisecond), nil) },
+			msg:  "retry.Func is nil",
+		},
+		{
+			name: "poll nil func",
+			run:  func() error { return retry.Poll(ctx, retry.Attempts(2, time.Millisecond), nil) },
+			msg:  "retry.Func is nil",
+		},
+		{
+			name: "result nil func",
+			run: func() error {
+				_, err := retry.UntilResult[int](ctx, retry.Attempts(2, time.Millisecond), nil)
+				return err
+			},
+			msg: "retry.Func is nil",
+		},
+		{
+			name: "race nil back off",
+			run:  func() error { return retry.Race(ctx, nil, noop) },
+			msg:  "back off is nil",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			require.NotPanics(t, func() { err = tt.run() })
+
+			var retryErr *retry.Err
+			require.True(t, errors.As(err, &retryErr))
+			assert.Equal(t, retry.Misconfigured, retryErr.Reason)
+			assert.Equal(t, 0, retryErr.Attempts)
+			assert.True(t, errors.Is(err, retry.ErrMisconfigured))
+			assert.Equal(t, "on attempt '0'; misconfigured: "+tt.msg+": misconfigured back off", err.Error())
+		})
+	}
+}
+
+func TestDefaultExponential(t *testing.T) {
+	backOff := retry.DefaultExponential()
+	assert.Equal(t, 100*time.Millisecond, backOff.Min)
+	assert.Equal(t, 30*time.Second, backOff.Max)
+	assert.Equal(t, float64(2), backOff.Factor)
+	assert.Equal(t, 0.2, backOff.Jitter)
+	assert.Equal(t, int64(0), backOff.Attempts)
+	assert.Equal(t, time.Duration(0), backOff.MaxElapsed)
+
+	// Each call returns an independent instance
+	backOff.Next()
+	assert.False(t, backOff == retry.DefaultExponential())
+	assert.Equal(t, 0, retry.DefaultExponential().NumRetries())
+}
+
+func TestExponentialJitter(t *testing.T) {
+	rec, backOff := retry.RecordIntervals(&retry.ExponentialBackOff{
+		Min:    time.Millisecond,
+		Max:    time.Second,
+		Factor: 2,
+		Jitter: 0.5,
+	})
+
+	for i := 0; i < 100; i++ {
+		backOff.Next()
+	}
+
+	var jittered bool
+	for i, d := range rec.Intervals() {
+		assert.True(t, d >= time.Millisecond && d <= time.Second, "interval %s out of range", d)
+		nominal := time.Millisecond * time.Duration(1<<uint(i+1))
+		if nominal > time.Second {
+			nominal = time.Second
+		}
+		if d != nominal {
+			jittered = true
+		}
+	}
+	assert.True(t, jittered)
+}
+
+func TestMaxTotalDuration(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		backOff retry.BackOff
+		total   time.Duration
+		bounded bool
+	}{
+		{
+			name:    "interval",
+			backOff: retry.Interval(time.Second),
+		},
+		{
+			name:    "attempts",
+			backOff: retry.Attempts(4, time.Millisecond*10),
+			total:   time.Millisecond * 30,
+			bounded: true,
+		},
+		{
+			name: "exponential",
+			backOff: &retry.ExponentialBackOff{
+				Min:      time.Millisecond,
+				Max:      time.Millisecond * 8,
+				Factor:   2,
+				Attempts: 5,
+			},
+			total:   time.Millisecond * (2 + 4 + 8 + 8 + 8),
+			bounded: true,
+		},
+		{
+			name: "exponential with jitter",
+			backOff: &retry.ExponentialBackOff{
+				Min:      time.Millisecond,
+				Max:      time.Millisecond * 8,
+				Factor:   2,
+				Attempts: 5,
+				Jitter:   0.5,
+			},
+			total:   time.Millisecond * (3 + 6 + 8 + 8 + 8),
+			bounded: true,
+		},
+		{
+			name: "exponential max elapsed",
+			backOff: &retry.ExponentialBackOff{
+				Min:        time.Millisecond,
+				Max:        time.Millisecond * 8,
+				Factor:     2,
+				MaxElapsed: time.Second,
+			},
+			total:   time.Second + time.Millisecond*8,
+			bounded: true,
+		},
+		{
+			name: "exponential unbounded",
+			backOff: &retry.ExponentialBackOff{
+				Min:    time.Millisecond,
+				Max:    time.Millisecond * 8,
+				Factor: 2,
+			},
+		},
+		{
+			name: "exponential many attempts",
+			backOff: &retry.ExponentialBackOff{
+				Min:      time.Millisecond,
+				Max:      time.Second,
+				Factor:   2,
+				Attempts: 1000000,
+			},
+			total:   time.Millisecond*(2+4+8+16+32+64+128+256+512) + time.Second*(1000000-9),
+			bounded: true,
+		},
+		{
+			name:    "sequence",
+			backOff: retry.Sequence(retry.Attempts(3, time.Millisecond), retry.Attempts(2, time.Second)),
+			total:   time.Millisecond*2 + time.Second,
+			bounded: true,
+		},
+		{
+			name:    "unbounded sequence",
+			backOff: retry.Sequence(retry.Attempts(3, time.Millisecond), retry.Interval(time.Second)),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			total, ok := retry.MaxTotalDuration(tt.backOff)
+			assert.Equal(t, tt.bounded, ok)
+			assert.Equal(t, tt.total, total)
+		})
+	}
+}
+
+func TestMaxTotalDurationMatchesSchedule(t *testing.T) {
+	rec, backOff := retry.RecordIntervals(&retry.ExponentialBackOff{
+		Min:      time.Millisecond,
+		Max:      time.Millisecond * 50,
+		Factor:   3,
+		Attempts: 6,
+	})
+	for {
+		if _, ok := backOff.Next(); !ok {
+			break
+		}
+	}
+	var sum time.Duration
+	for _, d := range rec.Intervals() {
+		sum += d
+	}
+	total, ok := retry.MaxTotalDuration(backOff)
+	require.True(t, ok)
+	assert.Equal(t, sum, total)
+}
+
+func TestExponentialMaxElapsedClock(t *testing.T) {
+	fc := retry.NewFakeClock(time.Now())
+	backOff := &retry.ExponentialBackOff{
+		Min:        time.Second,
+		Max:        time.Minute,
+		Factor:     2,
+		MaxElapsed: time.Hour,
+		Clock:      fc,
+	}
+	err := errors.New("error")
+	done := make(chan error)
+	go func() {
+		done <- retry.Until(context.Background(), backOff, func(ctx context.Context, att int) error {
+			return err
+		}, retry.WithClock(fc))
+	}()
+
+	// Advance the fake clock until the back off expires, no real time passes
+	for {
+		select {
+		case err := <-done:
+			var retryErr *retry.Err
+			require.True(t, errors.As(err, &retryErr))
+			assert.Equal(t, retry.Expired, retryErr.Reason)
+			return
+		default:
+		}
+		if fc.Wait4Scheduled(1, time.Millisecond*10) {
+			fc.Advance(time.Minute)
+		}
+	}
+}
+
+func TestSpreadUntil(t *testing.T) {
+	fc := retry.NewFakeClock(time.Now())
+	backOff := &retry.SpreadBackOff{Deadline: fc.Now().Add(time.Minute), Attempts: 5, Clock: fc}
+	d, ok := retry.MaxTotalDuration(backOff)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, d)
+
+	// With instant attempts the window is divided evenly, leaving a slot after the last attempt
+	var total time.Duration
+	for i := 0; i < 4; i++ {
+		interval, retry := backOff.Next()
+		require.True(t, retry)
+		assert.Equal(t, 12*time.Second, interval)
+		fc.Advance(interval)
+		total += interval
+	}
+	assert.Equal(t, 48*time.Second, total)
+
+	_, retry := backOff.Next()
+	assert.False(t, retry)
+	assert.False(t, backOff.Expired())
+}
+
+func TestSpreadUntilAdaptsToElapsed(t *testing.T) {
+	fc := retry.NewFakeClock(time.Now())
+	deadline := fc.Now().Add(time.Minute)
+	backOff := &retry.SpreadBackOff{Deadline: deadline, Attempts: 4, Clock: fc}
+
+	// The first attempt took half the window, the rest is spread over the remaining retries
+	fc.Advance(30 * time.Second)
+	interval, retry := backOff.Next()
+	require.True(t, retry)
+	assert.Equal(t, 7500*time.Millisecond, interval)
+
+	for i := 0; i < 2; i++ {
+		fc.Advance(interval)
+		interval, _ = backOff.Next()
+	}
+	// The last attempt lands one interval before the deadline
+	assert.Equal(t, deadline.Add(-interval), fc.Now().Add(interval))
+}
+
+func TestSpreadUntilClock(t *testing.T) {
+	fc := retry.NewFakeClock(time.Now())
+	backOff := &retry.SpreadBackOff{Deadline: fc.Now().Add(time.Minute), Attempts: 4, Clock: fc}
+
+	// Only the fake clock moves the back off towards the deadline
+	fc.Advance(30 * time.Second)
+	interval, retry := backOff.Next()
+	require.True(t, retry)
+	assert.Equal(t, 7500*time.Millisecond, interval)
+
+	fc.Advance(30 * time.Second)
+	_, retry = backOff.New().Next()
+	assert.False(t, retry)
+}
+
+func TestSpreadUntilContextDeadline(t *testing.T) {
+	deadline := time.Now().Add(time.Millisecond * 300)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	// The final attempt is made before a context sharing the deadline expires
+	var attempts int
+	err := retry.Until(ctx, retry.SpreadUntil(deadline, 3), func(ctx context.Context, att int) error {
+		attempts = att
+		return errCause
+	})
+
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, retry.AttemptsExhausted, retryErr.Reason)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestSpreadUntilDeadlinePassed(t *testing.T) {
+	backOff := retry.SpreadUntil(time.Now().Add(time.Millisecond*20), 100)
+
+	var attempts int
+	err := retry.Until(context.Background(), backOff, func(ctx context.Context, att int) error {
+		attempts = att
+		time.Sleep(time.Millisecond * 10)
+		return errCause
+	})
+
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, retry.Expired, retryErr.Reason)
+	assert.True(t, attempts < 100)
+}
+
+func TestRateLimited(t *testing.T) {
+	backOff := &retry.RateLimitedBackOff{QPS: 20, Rand: rand.New(rand.NewSource(1))}
+
+	const n = 10000
+	var total time.Duration
+	for i := 0; i < n; i++ {
+		interval, retry := backOff.Next()
+		require.True(t, retry)
+		// Full jitter between zero and twice the mean interval
+		require.True(t, interval >= 0 && interval < 100*time.Millisecond, "interval %s out of range", interval)
+		total += interval
+	}
+	assert.Equal(t, n, backOff.NumRetries())
+
+	// The mean interval approximates 1/QPS
+	mean := total / n
+	assert.InDelta(t, float64(50*time.Millisecond), float64(mean), float64(time.Millisecond), "mean %s", mean)
+
+	_, ok := retry.MaxTotalDuration(backOff)
+	assert.False(t, ok)
+}
+
+func TestExponentialResume(t *testing.T) {
+	newBackOff := func() *retry.ExponentialBackOff {
+		return &retry.ExponentialBackOff{Min: time.Millisecond, Max: time.Hour, Factor: 2, Attempts: 10}
+	}
+
+	// The intervals of a back off which was never interrupted
+	fresh := newBackOff()
+	var expected []time.Duration
+	for {
+		interval, retry := fresh.Next()
+		if !retry {
+			break
+		}
+		expected = append(expected, interval)
+	}
+
+	// A back off resumed after 5 retries continues with the 6th interval
+	resumed := newBackOff()
+	resumed.Resume(5)
+	assert.Equal(t, 5, resumed.NumRetries())
+	var intervals []time.Duration
+	for {
+		interval, retry := resumed.Next()
+		if !retry {
+			break
+		}
+		intervals = append(intervals, interval)
+	}
+	assert.Equal(t, 64*time.Millisecond, intervals[0])
+	assert.Equal(t, expected[5:], intervals)
+
+	// Reset starts over from Min
+	resumed.Reset()
+	interval, _ := resumed.Next()
+	assert.Equal(t, 2*time.Millisecond, interval)
+}
+
+func TestExponentialFirstInterval(t *testing.T) {
+	rec, backOff := retry.RecordIntervals(&retry.ExponentialBackOff{
+		Min:           time.Millisecond * 10,
+		Max:           time.Second,
+		Factor:        2,
+		Attempts:      4,
+		FirstInterval: time.Millisecond,
+	})
+
+	err := retry.Until(context.Background(), backOff, func(ctx context.Context, att int) error {
+		return errCause
+	})
+	require.Error(t, err)
+
+	// A quick first retry, then the usual progression of Min * Factor^N from the second retry
+	assert.Equal(t, []time.Duration{
+		time.Millisecond,
+		time.Millisecond * 40,
+		time.Millisecond * 80,
+		time.Millisecond * 160,
+	}, rec.Intervals())
+
+	d, ok := retry.MaxTotalDuration(backOff)
+	assert.True(t, ok)
+	assert.Equal(t, time.Millisecond*(1+40+80+160), d)
+
+	// Unset keeps the original progression
+	interval, _ := (&retry.ExponentialBackOff{Min: time.Millisecond * 10, Max: time.Second, Factor: 2}).Next()
+	assert.Equal(t, time.Millisecond*20, interval)
+}
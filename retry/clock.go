@@ -0,0 +1,30 @@
+package retry
+
+import (
+	"time"
+
+	"github.com/mailgun/holster/v3/clock"
+)
+
+// Clock is the source of time used to sleep between attempts. Any `clock.Clock`
+// from the holster clock package satisfies this interface.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) clock.Timer
+}
+
+// defaultClock is the real clock, time frozen via `clock.Freeze()` is ignored such that
+// freezing time elsewhere in a test never stalls a retry. Pass `clock.Realtime()` or a
+// `FakeClock` to `retry.WithClock()` to control the time seen by a retry.
+type defaultClock struct{}
+
+func (defaultClock) Now() time.Time                       { return clock.Realtime().Now() }
+func (defaultClock) NewTimer(d time.Duration) clock.Timer { return clock.Realtime().NewTimer(d) }
+
+// nowFrom returns the current time of `c` or of the real clock if `c` is nil
+func nowFrom(c Clock) time.Time {
+	if c == nil {
+		return defaultClock{}.Now()
+	}
+	return c.Now()
+}
@@ -0,0 +1,33 @@
+package retry
+
+import "context"
+
+// attemptKey is unexported so it can never collide with context keys from other packages
+type attemptKey struct{}
+
+// errorsKey holds the errors of previous attempts when `retry.WithErrorHistory()` is used
+type errorsKey struct{}
+
+func withAttempt(ctx context.Context, attempt int) context.Context {
+	return context.WithValue(ctx, attemptKey{}, attempt)
+}
+
+// AttemptFromContext returns the current attempt number from a context passed to a
+// `retry.Func`. When retries are nested the attempt of the innermost retry is returned.
+func AttemptFromContext(ctx context.Context) (int, bool) {
+	attempt, ok := ctx.Value(attemptKey{}).(int)
+	return attempt, ok
+}
+
+func withErrors(ctx context.Context, errs []error) context.Context {
+	return context.WithValue(ctx, errorsKey{}, errs)
+}
+
+// ErrorsFromContext returns the errors of the previous attempts, oldest first, from a context
+// passed to a `retry.Func`. At most `n` errors are kept where `n` is the size provided via
+// `retry.WithErrorHistory()`, returns nil if the option was not used or this is the first attempt.
+// The returned slice is a copy which the caller may modify.
+func ErrorsFromContext(ctx context.Context) []error {
+	errs, _ := ctx.Value(errorsKey{}).([]error)
+	return errs
+}
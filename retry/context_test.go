@@ -0,0 +1,158 @@
+package retry_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mailgun/holster/v3/retry"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type otherKey string
+
+func TestAttemptFromContext(t *testing.T) {
+	// Unrelated context values must not interfere with the retry attempt
+	ctx := context.WithValue(context.Background(), otherKey("attempt"), "not an attempt")
+	ctx = context.WithValue(ctx, "attempt", 100)
+
+	var attempts []int
+	_ = retry.Until(ctx, retry.Attempts(3, time.Millisecond), func(ctx context.Context, att int) error {
+		got, ok := retry.AttemptFromContext(ctx)
+		assert.True(t, ok)
+		assert.Equal(t, att, got)
+		assert.Equal(t, "not an attempt", ctx.Value(otherKey("attempt")))
+		attempts = append(attempts, got)
+		return errCause
+	})
+	assert.Equal(t, []int{1, 2, 3}, attempts)
+
+	_, ok := retry.AttemptFromContext(ctx)
+	assert.False(t, ok)
+}
+
+func TestErrorsFromContext(t *testing.T) {
+	errTimeout := errors.New("timeout")
+	var history [][]error
+	err := retry.Until(context.Background(), retry.Attempts(10, time.Millisecond), func(ctx context.Context, att int) error {
+		errs := retry.ErrorsFromContext(ctx)
+		history = append(history, errs)
+
+		// Stop once the same error has repeated three times
+		if len(errs) == 3 && errs[0] == errs[1] && errs[1] == errs[2] {
+			return retry.Stop(errs[2])
+		}
+		if att == 1 {
+			return errCause
+		}
+		return errTimeout
+	}, retry.WithErrorHistory(3))
+
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, retry.Stopped, retryErr.Reason)
+	assert.Equal(t, 5, retryErr.Attempts)
+	assert.Equal(t, errTimeout, retryErr.Err)
+
+	// Only the last three errors are kept
+	assert.Equal(t, [][]error{
+		nil,
+		{errCause},
+		{errCause, errTimeout},
+		{errCause, errTimeout, errTimeout},
+		{errTimeout, errTimeout, errTimeout},
+	}, history)
+}
+
+func TestErrorsFromContextBounded(t *testing.T) {
+	run := func(n int) []error {
+		var last []error
+		_ = retry.Until(context.Background(), retry.Attempts(50, time.Microsecond), func(ctx context.Context, att int) error {
+			last = retry.ErrorsFromContext(ctx)
+			return fmt.Errorf("attempt %d", att)
+		}, retry.WithErrorHistory(n))
+		return last
+	}
+
+	// Many more attempts than the cap only keep the newest errors
+	last := run(3)
+	require.Len(t, last, 3)
+	assert.Equal(t, "attempt 47", last[0].Error())
+	assert.Equal(t, "attempt 49", last[2].Error())
+
+	// Without a positive cap the default of ten applies
+	last = run(0)
+	require.Len(t, last, 10)
+	assert.Equal(t, "attempt 40", last[0].Error())
+	assert.Equal(t, "attempt 49", last[9].Error())
+}
+
+func TestErrorsFromContextDisabled(t *testing.T) {
+	_ = retry.Until(context.Background(), retry.Attempts(3, time.Millisecond), func(ctx context.Context, att int) error {
+		assert.Nil(t, retry.ErrorsFromContext(ctx))
+		return errCause
+	})
+}
+
+func TestNestedUntil(t *testing.T) {
+	var inner [][]int
+	err := retry.Until(context.Background(), retry.Attempts(3, time.Millisecond), func(ctx context.Context, outerAtt int) error {
+		var attempts []int
+		err := retry.Until(ctx, retry.Attempts(2, time.Millisecond), func(ctx context.Context, innerAtt int) error {
+			// The innermost attempt is reported and the history of the outer retry is not visible
+			got, ok := retry.AttemptFromContext(ctx)
+			assert.True(t, ok)
+			assert.Equal(t, innerAtt, got)
+			assert.Nil(t, retry.ErrorsFromContext(ctx))
+			attempts = append(attempts, innerAtt)
+			return errCause
+		})
+		inner = append(inner, attempts)
+
+		// The inner retry does not change the attempt seen by the outer retry
+		got, _ := retry.AttemptFromContext(ctx)
+		assert.Equal(t, outerAtt, got)
+		assert.Len(t, retry.ErrorsFromContext(ctx), outerAtt-1)
+		return err
+	}, retry.WithErrorHistory(5))
+
+	// The inner retry fully exhausts on every outer attempt
+	assert.Equal(t, [][]int{{1, 2}, {1, 2}, {1, 2}}, inner)
+
+	// The reasons of both retries are preserved
+	var outerErr *retry.Err
+	require.True(t, errors.As(err, &outerErr))
+	assert.Equal(t, retry.AttemptsExhausted, outerErr.Reason)
+	assert.Equal(t, 3, outerErr.Attempts)
+
+	var innerErr *retry.Err
+	require.True(t, errors.As(outerErr.Err, &innerErr))
+	assert.Equal(t, retry.AttemptsExhausted, innerErr.Reason)
+	assert.Equal(t, 2, innerErr.Attempts)
+	assert.Equal(t, errCause, errors.Cause(err))
+	assert.Equal(t, "on attempt '3'; attempts exhausted: on attempt '2'; attempts exhausted: cause of error", err.Error())
+}
+
+func TestNestedUntilStop(t *testing.T) {
+	// A stop from the inner function only stops the inner retry
+	var outerAttempts int
+	err := retry.Until(context.Background(), retry.Attempts(3, time.Millisecond), func(ctx context.Context, att int) error {
+		outerAttempts = att
+		return retry.Until(ctx, retry.Attempts(5, time.Millisecond), func(ctx context.Context, att int) error {
+			return retry.Stop(errCause)
+		})
+	})
+
+	var outerErr *retry.Err
+	require.True(t, errors.As(err, &outerErr))
+	assert.Equal(t, retry.AttemptsExhausted, outerErr.Reason)
+	assert.Equal(t, 3, outerAttempts)
+
+	var innerErr *retry.Err
+	require.True(t, errors.As(outerErr.Err, &innerErr))
+	assert.Equal(t, retry.Stopped, innerErr.Reason)
+	assert.Equal(t, 1, innerErr.Attempts)
+}
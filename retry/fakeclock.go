@@ -0,0 +1,180 @@
+package retry
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mailgun/holster/v3/clock"
+)
+
+// FakeClock is a Clock which only moves forward when `Advance()` is called. It allows
+// tests to run retries with long intervals instantly via `retry.WithClock()` or
+// `AsyncOptions.Clock`. Unlike `clock.Freeze()` it does not change the time seen by
+// the rest of the program. Back offs with a time limit such as `ExponentialBackOff.MaxElapsed`
+// only see the fake time if the clock is also set on their `Clock` field.
+//
+//	fc := retry.NewFakeClock(time.Now())
+//	go retry.Until(ctx, retry.Interval(time.Hour), f, retry.WithClock(fc))
+//	fc.Wait4Scheduled(1, time.Second)
+//	fc.Advance(time.Hour)
+type FakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	count int
+	ch    chan struct{}
+}
+
+// NewFakeClock returns a FakeClock which reports `start` as the current time
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+// Now returns the current time of the fake clock
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// NewTimer returns a timer which fires once the clock is advanced past `d`, a timer
+// with a duration of zero or less fires immediately
+func (c *FakeClock) NewTimer(d time.Duration) clock.Timer {
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.start(t, d)
+	return t
+}
+
+// After returns a channel which receives the current time once the clock is advanced past `d`
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// Advance moves the clock forward by `d` firing all the timers with a deadline up
+// to and including the new time in deadline order.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	end := c.now.Add(d)
+	for len(c.timers) != 0 && !c.timers[0].when.After(end) {
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		c.now = t.when
+		t.fire()
+	}
+	c.now = end
+}
+
+// Wait4Scheduled waits until at least `count` timers are scheduled or the (real time)
+// timeout elapses. Returns false if the timeout elapsed. This allows a test to wait
+// for a retry running in another goroutine to begin sleeping before advancing the clock.
+func (c *FakeClock) Wait4Scheduled(count int, timeout time.Duration) bool {
+	c.mutex.Lock()
+	if len(c.timers) >= count {
+		c.mutex.Unlock()
+		return true
+	}
+	w := fakeWaiter{count: count, ch: make(chan struct{})}
+	c.waiters = append(c.waiters, w)
+	c.mutex.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-w.ch:
+		return true
+	case <-timer.C:
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.removeWaiter(w)
+		return false
+	}
+}
+
+// start schedules the timer, must be called while holding the lock
+func (c *FakeClock) start(t *fakeTimer, d time.Duration) {
+	t.when = c.now.Add(d)
+	if d <= 0 {
+		t.fire()
+		return
+	}
+
+	// Keep the timers sorted by deadline, timers with the same deadline fire in the order created
+	pos := len(c.timers)
+	for i, curr := range c.timers {
+		if t.when.Before(curr.when) {
+			pos = i
+			break
+		}
+	}
+	c.timers = append(c.timers, nil)
+	copy(c.timers[pos+1:], c.timers[pos:])
+	c.timers[pos] = t
+
+	for i := 0; i < len(c.waiters); i++ {
+		if len(c.timers) >= c.waiters[i].count {
+			close(c.waiters[i].ch)
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			i--
+		}
+	}
+}
+
+// stop removes the timer, returns false if the timer was not scheduled. Must be called while holding the lock
+func (c *FakeClock) stop(t *fakeTimer) bool {
+	for i, curr := range c.timers {
+		if curr == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *FakeClock) removeWaiter(w fakeWaiter) {
+	for i, curr := range c.waiters {
+		if curr.ch == w.ch {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	when  time.Time
+	c     chan time.Time
+}
+
+// fire sends the deadline on the channel without blocking, like a `time.Timer`
+func (t *fakeTimer) fire() {
+	select {
+	case t.c <- t.when:
+	default:
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	return t.clock.stop(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := t.clock.stop(t)
+	t.clock.start(t, d)
+	return active
+}
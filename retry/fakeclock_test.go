@@ -0,0 +1,113 @@
+package retry_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mailgun/holster/v3/retry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeClockAdvance(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fc := retry.NewFakeClock(start)
+	assert.Equal(t, start, fc.Now())
+
+	// Timers created in any order fire in deadline order
+	late := fc.After(3 * time.Second)
+	early := fc.After(time.Second)
+	middle := fc.NewTimer(2 * time.Second)
+
+	fc.Advance(500 * time.Millisecond)
+	assertNotFired(t, early)
+	assert.Equal(t, start.Add(500*time.Millisecond), fc.Now())
+
+	fc.Advance(2 * time.Second)
+	assert.Equal(t, start.Add(time.Second), <-early)
+	assert.Equal(t, start.Add(2*time.Second), <-middle.C())
+	assertNotFired(t, late)
+
+	// Reset reports false for a timer which already fired, a stopped timer never fires
+	assert.False(t, middle.Reset(time.Second))
+	assert.True(t, middle.Stop())
+	assert.False(t, middle.Stop())
+
+	fc.Advance(time.Hour)
+	assert.Equal(t, start.Add(3*time.Second), <-late)
+	assertNotFired(t, middle.C())
+	assert.Equal(t, start.Add(2*time.Second+500*time.Millisecond+time.Hour), fc.Now())
+}
+
+func TestFakeClockZeroDuration(t *testing.T) {
+	fc := retry.NewFakeClock(time.Now())
+	select {
+	case <-fc.After(0):
+	default:
+		t.Fatal("zero duration timer should fire immediately")
+	}
+}
+
+func TestFakeClockWait4Scheduled(t *testing.T) {
+	fc := retry.NewFakeClock(time.Now())
+	assert.False(t, fc.Wait4Scheduled(1, 10*time.Millisecond))
+
+	go fc.After(time.Second)
+	assert.True(t, fc.Wait4Scheduled(1, time.Second))
+}
+
+func TestFakeClockUntil(t *testing.T) {
+	fc := retry.NewFakeClock(time.Now())
+
+	done := make(chan error)
+	go func() {
+		done <- retry.Until(context.Background(), retry.Attempts(3, time.Hour), func(ctx context.Context, att int) error {
+			return errCause
+		}, retry.WithClock(fc))
+	}()
+
+	// Each sleep between attempts waits for the clock to advance
+	for i := 0; i < 2; i++ {
+		require.True(t, fc.Wait4Scheduled(1, time.Second))
+		fc.Advance(time.Hour)
+	}
+	err := <-done
+	require.Error(t, err)
+	assert.Equal(t, "on attempt '3'; attempts exhausted: cause of error", err.Error())
+}
+
+func assertNotFired(t *testing.T, c <-chan time.Time) {
+	t.Helper()
+	select {
+	case <-c:
+		t.Fatal("timer fired early")
+	default:
+	}
+}
+
+func ExampleFakeClock() {
+	fc := retry.NewFakeClock(time.Now())
+
+	// Advance the clock whenever the retry starts to sleep, the retry
+	// completes instantly even though each interval is an hour long
+	go func() {
+		for fc.Wait4Scheduled(1, time.Second) {
+			fc.Advance(time.Hour)
+		}
+	}()
+
+	err := retry.Until(context.Background(), retry.Attempts(10, time.Hour), func(ctx context.Context, att int) error {
+		if att < 5 {
+			return fmt.Errorf("attempt %d failed", att)
+		}
+		fmt.Printf("succeeded on attempt %d\n", att)
+		return nil
+	}, retry.WithClock(fc))
+	fmt.Println(err)
+
+	// Output:
+	// succeeded on attempt 5
+	// <nil>
+}
@@ -0,0 +1,215 @@
+/*
+Package httpretry provides an http.RoundTripper which retries requests
+according to a retry.BackOff
+*/
+package httpretry
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mailgun/holster/v3/clock"
+	"github.com/mailgun/holster/v3/retry"
+	"github.com/pkg/errors"
+)
+
+// The maximum number of bytes read from a response body before it is closed
+// between attempts, this allows the underlying connection to be re-used
+const maxDrainBytes = 4096
+
+// The longest wait requested via `Retry-After` which is honoured by default
+const defaultMaxRetryAfter = time.Minute
+
+var (
+	defaultMethods = []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete}
+	defaultStatus  = []int{
+		http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	}
+)
+
+type Option func(*RoundTripper)
+
+// WithMethods overrides the list of HTTP methods which are considered
+// idempotent and safe to retry. Defaults to GET, HEAD, PUT and DELETE
+func WithMethods(methods ...string) Option {
+	return func(rt *RoundTripper) {
+		rt.methods = toSet(methods)
+	}
+}
+
+// WithStatus overrides the list of HTTP status codes which will be retried.
+// Defaults to 408, 429, 500, 502, 503 and 504
+func WithStatus(codes ...int) Option {
+	return func(rt *RoundTripper) {
+		rt.status = make(map[int]bool, len(codes))
+		for _, c := range codes {
+			rt.status[c] = true
+		}
+	}
+}
+
+// WithMaxRetryAfter caps the wait requested by a server via `Retry-After`, a longer wait is
+// shortened to `max`. Defaults to one minute, a max of zero honours any wait requested.
+func WithMaxRetryAfter(max time.Duration) Option {
+	return func(rt *RoundTripper) {
+		rt.maxRetryAfter = max
+	}
+}
+
+// WithClock sets the clock used to sleep between attempts and to interpret a `Retry-After`
+// date, which allows tests to use a `retry.FakeClock`. Defaults to the real clock.
+func WithClock(c retry.Clock) Option {
+	return func(rt *RoundTripper) {
+		rt.clock = c
+	}
+}
+
+// RoundTripper retries requests made through the `next` round tripper
+type RoundTripper struct {
+	next          http.RoundTripper
+	backOff       retry.BackOff
+	methods       map[string]bool
+	status        map[int]bool
+	clock         retry.Clock
+	maxRetryAfter time.Duration
+}
+
+// NewRoundTripper returns a round tripper which retries idempotent requests which
+// fail with a transport error or a retryable status code. Each request gets its
+// own copy of `backOff` via `BackOff.New()`. If the server responds with a
+// `Retry-After` header the round tripper waits for the duration requested by
+// the server instead of the interval provided by the back off, up to the max
+// set via `WithMaxRetryAfter()`. If the wait would outlast the deadline of the
+// request context the response is returned immediately instead.
+//
+// Requests with a body are only retried if `http.Request.GetBody` is set, which
+// `http.NewRequest()` does for the common body types.
+func NewRoundTripper(next http.RoundTripper, backOff retry.BackOff, opts ...Option) *RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	rt := &RoundTripper{
+		next:          next,
+		backOff:       backOff,
+		methods:       toSet(defaultMethods),
+		clock:         clock.Realtime(),
+		maxRetryAfter: defaultMaxRetryAfter,
+	}
+	WithStatus(defaultStatus...)(rt)
+
+	for _, opt := range opts {
+		opt(rt)
+	}
+	return rt
+}
+
+// RoundTrip implements http.RoundTripper. The final response or error is
+// returned once the request succeeds, fails with a non retryable status, the
+// back off is exhausted or the request context is cancelled.
+func (rt *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !rt.methods[req.Method] {
+		return rt.next.RoundTrip(req)
+	}
+
+	// We can not retry a request if we are unable to rewind the body
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return rt.next.RoundTrip(req)
+	}
+
+	ctx := req.Context()
+	backOff := rt.backOff.New()
+	for attempt := 1; ; attempt++ {
+		r := req
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, errors.Wrap(err, "while rewinding request body")
+			}
+			r = req.Clone(ctx)
+			r.Body = body
+		}
+
+		resp, err := rt.next.RoundTrip(r)
+		if err == nil && !rt.status[resp.StatusCode] {
+			return resp, nil
+		}
+
+		// Don't retry if the caller has given up
+		if ctx.Err() != nil {
+			return resp, err
+		}
+
+		interval, ok := backOff.Next()
+		if !ok {
+			return resp, err
+		}
+
+		if resp != nil {
+			now := rt.clock.Now()
+			if d, ok := retryAfter(resp, now); ok {
+				if rt.maxRetryAfter > 0 && d > rt.maxRetryAfter {
+					d = rt.maxRetryAfter
+				}
+				// Waiting past the deadline would only end in a context error, hand the
+				// server's response to the caller while it is still useful
+				if deadline, ok := ctx.Deadline(); ok && now.Add(d).After(deadline) {
+					return resp, err
+				}
+				interval = d
+			}
+			drain(resp.Body)
+		}
+
+		timer := rt.clock.NewTimer(interval)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// retryAfter parses the `Retry-After` header which may contain either
+// the number of seconds to wait or a HTTP date relative to `now`
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if sec, err := strconv.Atoi(v); err == nil {
+		if sec < 0 {
+			return 0, false
+		}
+		return time.Duration(sec) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := t.Sub(now)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+func drain(body io.ReadCloser) {
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(body, maxDrainBytes))
+	_ = body.Close()
+}
+
+func toSet(methods []string) map[string]bool {
+	set := make(map[string]bool, len(methods))
+	for _, m := range methods {
+		set[m] = true
+	}
+	return set
+}
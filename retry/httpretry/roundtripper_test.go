@@ -0,0 +1,241 @@
+package httpretry_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mailgun/holster/v3/retry"
+	"github.com/mailgun/holster/v3/retry/httpretry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failFirst returns a handler which responds with `code` for the first `n` requests
+func failFirst(n int32, code int, count *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(count, 1) <= n {
+			w.WriteHeader(code)
+			_, _ = w.Write([]byte("try again"))
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}
+}
+
+func TestRoundTripperRetries(t *testing.T) {
+	var count int32
+	srv := httptest.NewServer(failFirst(2, http.StatusServiceUnavailable, &count))
+	defer srv.Close()
+
+	client := &http.Client{
+		Transport: httpretry.NewRoundTripper(nil, retry.Attempts(5, time.Millisecond)),
+	}
+
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ok", string(body))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&count))
+}
+
+func TestRoundTripperExhausted(t *testing.T) {
+	var count int32
+	srv := httptest.NewServer(failFirst(10, http.StatusBadGateway, &count))
+	defer srv.Close()
+
+	client := &http.Client{
+		Transport: httpretry.NewRoundTripper(nil, retry.Attempts(3, time.Millisecond)),
+	}
+
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	// The final response is returned to the caller with the body intact
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, "try again", string(body))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&count))
+}
+
+func TestRoundTripperNonRetryable(t *testing.T) {
+	var count int32
+	srv := httptest.NewServer(failFirst(10, http.StatusBadRequest, &count))
+	defer srv.Close()
+
+	client := &http.Client{
+		Transport: httpretry.NewRoundTripper(nil, retry.Attempts(3, time.Millisecond)),
+	}
+
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+}
+
+func TestRoundTripperMethods(t *testing.T) {
+	var count int32
+	srv := httptest.NewServer(failFirst(10, http.StatusServiceUnavailable, &count))
+	defer srv.Close()
+
+	client := &http.Client{
+		Transport: httpretry.NewRoundTripper(nil, retry.Attempts(3, time.Millisecond)),
+	}
+
+	// POST is not idempotent and should not be retried by default
+	resp, err := client.Post(srv.URL, "text/plain", strings.NewReader("body"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+}
+
+func TestRoundTripperRewindsBody(t *testing.T) {
+	var count int32
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if atomic.AddInt32(&count, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}))
+	defer srv.Close()
+
+	client := &http.Client{
+		Transport: httpretry.NewRoundTripper(nil, retry.Attempts(5, time.Millisecond),
+			httpretry.WithMethods(http.MethodPost)),
+	}
+
+	resp, err := client.Post(srv.URL, "text/plain", strings.NewReader("payload"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"payload", "payload", "payload"}, bodies)
+}
+
+func TestRoundTripperRetryAfter(t *testing.T) {
+	var count int32
+	srv := httptest.NewServer(retryAfterFirst("1", &count))
+	defer srv.Close()
+
+	fc := retry.NewFakeClock(time.Now())
+	client := &http.Client{
+		Transport: httpretry.NewRoundTripper(nil, retry.Attempts(3, time.Millisecond), httpretry.WithClock(fc)),
+	}
+
+	done := make(chan *http.Response, 1)
+	go func() {
+		resp, err := client.Get(srv.URL)
+		assert.NoError(t, err)
+		done <- resp
+	}()
+
+	// The round tripper waits for the second requested by the server, not the back off interval
+	require.True(t, fc.Wait4Scheduled(1, time.Second))
+	fc.Advance(time.Second - time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+	fc.Advance(time.Millisecond)
+
+	resp := <-done
+	require.NotNil(t, resp)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+}
+
+// retryAfterFirst returns a handler which asks the client to retry after `after`
+// on the first request and succeeds on later requests
+func retryAfterFirst(after string, count *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(count, 1) == 1 {
+			w.Header().Set("Retry-After", after)
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}
+}
+
+func TestRoundTripperMaxRetryAfter(t *testing.T) {
+	var count int32
+	srv := httptest.NewServer(retryAfterFirst("3600", &count))
+	defer srv.Close()
+
+	fc := retry.NewFakeClock(time.Now())
+	client := &http.Client{
+		Transport: httpretry.NewRoundTripper(nil, retry.Attempts(3, time.Millisecond),
+			httpretry.WithClock(fc), httpretry.WithMaxRetryAfter(time.Second)),
+	}
+
+	done := make(chan *http.Response, 1)
+	go func() {
+		resp, err := client.Get(srv.URL)
+		assert.NoError(t, err)
+		done <- resp
+	}()
+
+	// The hour requested by the server is capped to a second
+	require.True(t, fc.Wait4Scheduled(1, time.Second))
+	fc.Advance(time.Second)
+
+	resp := <-done
+	require.NotNil(t, resp)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+}
+
+func TestRoundTripperRetryAfterDeadline(t *testing.T) {
+	var count int32
+	srv := httptest.NewServer(retryAfterFirst("30", &count))
+	defer srv.Close()
+
+	client := &http.Client{
+		Transport: httpretry.NewRoundTripper(nil, retry.Attempts(3, time.Millisecond)),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+
+	// A wait which outlasts the deadline returns the response of the server immediately
+	start := time.Now()
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestRoundTripperCancelled(t *testing.T) {
+	var count int32
+	srv := httptest.NewServer(failFirst(100, http.StatusServiceUnavailable, &count))
+	defer srv.Close()
+
+	client := &http.Client{
+		Transport: httpretry.NewRoundTripper(nil, retry.Interval(time.Millisecond*10)),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+
+	_, err = client.Do(req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), context.DeadlineExceeded.Error())
+}
@@ -0,0 +1,527 @@
+package retry
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Option configures the optional behavior of `retry.Until()`
+type Option func(*options)
+
+// The number of errors kept by `retry.WithErrorHistory()` when no positive cap is given
+const defaultErrorHistory = 10
+
+// SetupFunc prepares resources for an attempt, the returned cleanup func if not nil
+// is called once the attempt completes
+type SetupFunc func(attempt int) (cleanup func(), err error)
+
+// ErrPanic is the cause of an attempt which panicked when `retry.WithRecover()` is used
+var ErrPanic = errors.New("panic during attempt")
+
+// ErrNoFault is returned by a fault injector provided via `retry.WithFaultInjector()` to
+// leave the outcome of an attempt untouched
+var ErrNoFault = errors.New("no fault injected")
+
+// Metrics is notified of the outcome and duration of every attempt
+type Metrics interface {
+	// ObserveAttempt is called after every attempt with the name of the operation provided
+	// via `retry.WithName()`, the error is nil if the attempt succeeded
+	ObserveAttempt(name string, attempt int, d time.Duration, err error)
+}
+
+// Tracer starts a span for each attempt when provided via `retry.WithTracer()`, which
+// allows attempts to be traced without this package depending on a tracing library
+type Tracer interface {
+	// StartAttempt is called before each attempt, the returned context is passed to the
+	// attempt and the returned func is called with the outcome once the attempt completes
+	StartAttempt(ctx context.Context, attempt int) (context.Context, func(err error))
+}
+
+// CircuitBreaker is consulted by `retry.Until()` before each attempt when provided via
+// `retry.WithCircuitBreaker()`. The interface is minimal such that most circuit breaker
+// implementations can be adapted to it.
+type CircuitBreaker interface {
+	// Allow reports if an attempt may be made, a half open breaker should allow a single probe
+	Allow() bool
+	// Success records an attempt which succeeded
+	Success()
+	// Failure records an attempt which failed
+	Failure()
+}
+
+// RetryInfo describes the sleep between a failed attempt and the next attempt
+type RetryInfo struct {
+	// Attempt is the attempt which failed
+	Attempt int
+	// Err is the error returned by the failed attempt
+	Err error
+	// Interval is the interval returned by the back off, including any jitter applied by the back off
+	Interval time.Duration
+	// Wait is the time the retry intended to sleep, which differs from Interval when the attempt
+	// asked to sleep until a given time via `retry.Sleep()` or `retry.WithDeadlineClamp()` applies
+	Wait time.Duration
+	// Slept is the time actually slept, which is less than Wait if the context was cancelled
+	Slept time.Duration
+}
+
+// SuccessInfo describes the timing of a retry which succeeded, all durations are measured
+// from the call to `retry.Until()` such that `TimeToSuccess - TimeToFirstAttempt` is the time
+// spent on failed attempts and sleeping while `TotalElapsed - TimeToSuccess` is the duration
+// of the successful attempt.
+type SuccessInfo struct {
+	// Attempt is the attempt which succeeded
+	Attempt int
+	// TimeToFirstAttempt is the time until the first attempt started, which includes any initial delay
+	TimeToFirstAttempt time.Duration
+	// TimeToSuccess is the time until the successful attempt started
+	TimeToSuccess time.Duration
+	// TotalElapsed is the time until the successful attempt completed
+	TotalElapsed time.Duration
+}
+
+type options struct {
+	name      string
+	retryIf   func(error) bool
+	setup     SetupFunc
+	onRetry   func(RetryInfo)
+	onSuccess func(SuccessInfo)
+
+	onExhausted func(lastErr error, attempts int)
+	onCancelled func(lastErr error, attempts int)
+
+	initialDelayMin   time.Duration
+	initialDelayMax   time.Duration
+	attemptsMin       int
+	attemptsMax       int
+	rand              *rand.Rand
+	clock             Clock
+	deadlineAsFailure bool
+	logger            logrus.FieldLogger
+	metrics           Metrics
+	recover           bool
+	errorHistory      int
+	breaker           CircuitBreaker
+	tracer            Tracer
+	clamp             bool
+	clampMargin       time.Duration
+	deadlineCheck     bool
+	deadlineStrict    bool
+	faultInjector     func(attempt int) error
+	errorChanged      func(prev, cur error) bool
+	attemptTimeout    time.Duration
+	successCondition  func(attempt int) bool
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{clock: defaultClock{}, deadlineAsFailure: true}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// attempt runs a single attempt of `f` applying any per attempt options
+func (o *options) attempt(ctx context.Context, attempt int, f Func) (err error) {
+	ctx = withAttempt(ctx, attempt)
+	if o.attemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.attemptTimeout)
+		defer cancel()
+	}
+	if o.metrics != nil {
+		start := o.clock.Now()
+		defer func() {
+			o.metrics.ObserveAttempt(o.name, attempt, o.clock.Now().Sub(start), err)
+		}()
+	}
+	if o.tracer != nil {
+		var end func(error)
+		ctx, end = o.tracer.StartAttempt(ctx, attempt)
+		// Registered before the recover such that a recovered panic is reported as the outcome
+		defer func() { end(err) }()
+	}
+	if o.recover {
+		defer func() {
+			if r := recover(); r != nil {
+				err = errors.Wrapf(ErrPanic, "%v", r)
+			}
+		}()
+	}
+	if o.setup != nil {
+		cleanup, err := o.setup(attempt)
+		if cleanup != nil {
+			defer cleanup()
+		}
+		if err != nil {
+			return err
+		}
+		// Avoid calling `f` if the context was cancelled while we were setting up
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	err = f(ctx, attempt)
+	if o.faultInjector != nil {
+		if fault := o.faultInjector(attempt); fault != ErrNoFault {
+			err = fault
+		}
+	}
+	if err == nil && o.successCondition != nil && !o.successCondition(attempt) {
+		return ErrNotDone
+	}
+	return err
+}
+
+// int63n returns a random number in [0,n) from the source provided via `WithRand()`
+func (o *options) int63n(n int64) int64 {
+	if o.rand != nil {
+		return o.rand.Int63n(n)
+	}
+	return rand.Int63n(n)
+}
+
+// initialDelay returns the delay before the first attempt
+func (o *options) initialDelay() time.Duration {
+	if o.initialDelayMax <= o.initialDelayMin {
+		return o.initialDelayMin
+	}
+	return o.initialDelayMin + time.Duration(o.int63n(int64(o.initialDelayMax-o.initialDelayMin)))
+}
+
+// maxAttempts returns the maximum number of attempts or zero if the attempts are not capped
+func (o *options) maxAttempts() int {
+	if o.attemptsMax <= o.attemptsMin {
+		return o.attemptsMin
+	}
+	return o.attemptsMin + int(o.int63n(int64(o.attemptsMax-o.attemptsMin+1)))
+}
+
+// clampToDeadline shortens an interval which would end after the deadline of the context, less
+// the margin, such that the next attempt still runs before the deadline. Once the deadline is
+// within the margin the interval is left untouched, so a failing attempt is never retried in a
+// tight loop until the deadline.
+func (o *options) clampToDeadline(ctx context.Context, interval time.Duration) time.Duration {
+	if !o.clamp {
+		return interval
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return interval
+	}
+	if remaining := deadline.Sub(o.clock.Now()) - o.clampMargin; remaining > 0 && interval > remaining {
+		return remaining
+	}
+	return interval
+}
+
+// checkDeadline returns an error if the back off could sleep for longer than the time remaining
+// before the deadline of the context, in which case the attempts of the back off can not be reached
+func (o *options) checkDeadline(ctx context.Context, backOff BackOff) error {
+	if !o.deadlineCheck {
+		return nil
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	total, ok := MaxTotalDuration(backOff)
+	if !ok {
+		return nil
+	}
+	if remaining := deadline.Sub(o.clock.Now()); total > remaining {
+		return errors.Errorf("back off may sleep for '%s' which exceeds the '%s' remaining before the context deadline",
+			total, remaining.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// sleep waits for the interval to elapse, returns the time slept and false if
+// the context was cancelled before the interval elapsed
+func (o *options) sleep(ctx context.Context, interval time.Duration) (time.Duration, bool) {
+	start := o.clock.Now()
+	timer := o.clock.NewTimer(interval)
+	select {
+	case <-timer.C():
+		return o.clock.Now().Sub(start), true
+	case <-ctx.Done():
+		if !timer.Stop() {
+			<-timer.C()
+		}
+		return o.clock.Now().Sub(start), false
+	}
+}
+
+// WithAttemptTimeout limits the duration of each attempt, the context passed to the attempt
+// has a deadline of `d` from the start of the attempt or the deadline of the context passed to
+// `retry.Until()`, whichever is sooner. Clients which respect the deadline of a context, like
+// HTTP clients and database drivers, give up on a slow attempt such that it can be retried.
+// An attempt which times out is retried unless `retry.TreatDeadlineAsFailure(false)` is used.
+func WithAttemptTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.attemptTimeout = d
+	}
+}
+
+// WithName names the operation being retried, the name is included in
+// the `retry.Err` returned when the retry fails
+func WithName(name string) Option {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+// WithRetryIf only retries errors for which the predicate returns true, any other
+// error stops the retry with Reason `retry.Stopped` as if `retry.Stop()` was returned
+func WithRetryIf(pred func(error) bool) Option {
+	return func(o *options) {
+		o.retryIf = pred
+	}
+}
+
+// AnyOf returns a predicate which reports true if any of the provided predicates
+// report true. Predicates are evaluated in order and the first true result short
+// circuits the rest. AnyOf with no predicates never retries.
+func AnyOf(preds ...func(error) bool) func(error) bool {
+	return func(err error) bool {
+		for _, p := range preds {
+			if p(err) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// AllOf returns a predicate which reports true only if all the provided predicates
+// report true. Predicates are evaluated in order and the first false result short
+// circuits the rest. AllOf with no predicates always retries.
+func AllOf(preds ...func(error) bool) func(error) bool {
+	return func(err error) bool {
+		for _, p := range preds {
+			if !p(err) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// StopOnErrorChange calls `changed` with the errors of consecutive failed attempts, if it
+// returns true the retry stops with Reason `retry.ErrorChanged` and the error of the latest
+// attempt. This allows a retry to give up when the failure turns into one that retrying will
+// not fix, such as a connection refused followed by a permission denied.
+func StopOnErrorChange(changed func(prev, cur error) bool) Option {
+	return func(o *options) {
+		o.errorChanged = changed
+	}
+}
+
+// WithSetup calls `setup` before each attempt to create any resources the attempt
+// requires, like a new connection or request body. If setup returns an error the
+// attempt is considered failed and `f` is not called. The cleanup func returned by
+// setup is called after the attempt regardless of the outcome.
+func WithSetup(setup SetupFunc) Option {
+	return func(o *options) {
+		o.setup = setup
+	}
+}
+
+// WithOnRetry calls `fn` after each sleep between attempts with both the interval
+// requested by the back off and the time actually slept
+func WithOnRetry(fn func(RetryInfo)) Option {
+	return func(o *options) {
+		o.onRetry = fn
+	}
+}
+
+// WithOnSuccess calls `fn` with the timing of the retry once an attempt succeeds,
+// which allows the time spent backing off to be reported separately from the time
+// spent on the successful attempt
+func WithOnSuccess(fn func(SuccessInfo)) Option {
+	return func(o *options) {
+		o.onSuccess = fn
+	}
+}
+
+// WithOnExhausted calls `fn` once with the error of the last attempt when the retry gives
+// up because the back off is exhausted, either with Reason `retry.AttemptsExhausted` or
+// `retry.Expired`. It is not called on success, when the retry is stopped or when the context
+// is cancelled, use `retry.WithOnCancelled()` as well to run the same action on cancellation.
+func WithOnExhausted(fn func(lastErr error, attempts int)) Option {
+	return func(o *options) {
+		o.onExhausted = fn
+	}
+}
+
+// WithOnCancelled calls `fn` once with the error of the last attempt, or the error of the
+// context if no attempt was made, when the retry gives up with Reason `retry.Cancelled`
+func WithOnCancelled(fn func(lastErr error, attempts int)) Option {
+	return func(o *options) {
+		o.onCancelled = fn
+	}
+}
+
+// WithInitialDelay waits a random duration between `min` and `max` before the first
+// attempt, which is useful to spread out the start of many workers which all start at
+// the same time. The delay does not affect the intervals of the back off, but counts
+// towards the deadline of the context. If the context is cancelled during the delay
+// the retry returns a `retry.Err` with Reason `retry.Cancelled` and no attempts.
+func WithInitialDelay(min, max time.Duration) Option {
+	return func(o *options) {
+		if min < 0 {
+			min = 0
+		}
+		o.initialDelayMin, o.initialDelayMax = min, max
+	}
+}
+
+// WithClock sets the clock used to sleep between attempts. Defaults to the real clock, which
+// ignores time frozen via `clock.Freeze()`, pass `clock.Realtime()` to share the frozen time
+// explicitly. Back offs which limit the time spent retrying keep their own `Clock` field,
+// such as `ExponentialBackOff.Clock`.
+func WithClock(c Clock) Option {
+	return func(o *options) {
+		o.clock = c
+	}
+}
+
+// TreatDeadlineAsFailure controls how a `context.DeadlineExceeded` returned by an attempt
+// is handled when the context passed to `retry.Until()` has not expired, for instance when
+// the attempt used its own timeout. When true, which is the default, it is retried like any
+// other failure. When false the retry is stopped with Reason `retry.Stopped`. Once the context
+// passed to `retry.Until()` is done the retry always ends with Reason `retry.Cancelled`.
+func TreatDeadlineAsFailure(retry bool) Option {
+	return func(o *options) {
+		o.deadlineAsFailure = retry
+	}
+}
+
+// WithLogger logs each failed attempt which will be retried at debug level
+func WithLogger(l logrus.FieldLogger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithMetrics reports the outcome and duration of every attempt to `m`
+func WithMetrics(m Metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
+
+// WithRecover recovers from a panic during an attempt, the panic is treated as
+// a failed attempt with an error that wraps `ErrPanic`
+func WithRecover() Option {
+	return func(o *options) {
+		o.recover = true
+	}
+}
+
+// WithAttemptJitter caps the number of attempts of each call to `retry.Until()` at a random
+// number between `min` and `max` inclusive, in addition to any limit of the back off. Under
+// heavy load this spreads out the time at which callers give up, which smooths the recovery
+// of the overloaded service. When the cap is reached the retry returns a `retry.Err` with
+// Reason `retry.AttemptsExhausted` and Attempts set to the chosen cap. A `min` of zero or
+// less disables the cap.
+func WithAttemptJitter(min, max int) Option {
+	return func(o *options) {
+		if min <= 0 {
+			o.attemptsMin, o.attemptsMax = 0, 0
+			return
+		}
+		o.attemptsMin, o.attemptsMax = min, max
+	}
+}
+
+// WithRand sets the source of randomness used by `WithInitialDelay()` and `WithAttemptJitter()`,
+// which defaults to the global source of the math/rand package. A `rand.Rand` is not safe for
+// concurrent use, do not share it between concurrent calls to `retry.Until()`.
+func WithRand(r *rand.Rand) Option {
+	return func(o *options) {
+		o.rand = r
+	}
+}
+
+// WithErrorHistory makes the errors of the last `n` attempts available to each attempt
+// via `retry.ErrorsFromContext()`, which allows an attempt to `retry.Stop()` when it sees
+// the same error repeat without keeping state outside of the retry. Only the newest `n`
+// errors are kept however long the retry runs, an `n` of zero or less keeps the last 10.
+func WithErrorHistory(n int) Option {
+	return func(o *options) {
+		if n <= 0 {
+			n = defaultErrorHistory
+		}
+		o.errorHistory = n
+	}
+}
+
+// WithCircuitBreaker asks `cb` before each attempt if the attempt is allowed and records the
+// outcome of each attempt. When the breaker denies an attempt the retry fails fast with a
+// `retry.Err` with Reason `retry.CircuitOpen` and cause `ErrCircuitOpen`. An attempt which
+// succeeds or returns `ErrNotDone`, as polls and unmet success conditions do, is recorded as a
+// success. An attempt which fails because the context passed to `retry.Until()` was cancelled
+// is not recorded, any other error is recorded as a failure.
+func WithCircuitBreaker(cb CircuitBreaker) Option {
+	return func(o *options) {
+		o.breaker = cb
+	}
+}
+
+// WithTracer starts a span via `tracer` before each attempt and ends it with the outcome
+// of the attempt. The span context returned by the tracer is passed to the attempt.
+func WithTracer(tracer Tracer) Option {
+	return func(o *options) {
+		o.tracer = tracer
+	}
+}
+
+// WithDeadlineClamp shortens a sleep which would otherwise end after the deadline of the
+// context, such that the next attempt starts `margin` before the deadline instead of the
+// retry being cancelled while it sleeps. This avoids wasting the final attempt of a bounded
+// retry when a long or jittered interval would overrun the deadline. The margin should
+// cover the time an attempt needs to complete.
+func WithDeadlineClamp(margin time.Duration) Option {
+	return func(o *options) {
+		o.clamp = true
+		o.clampMargin = margin
+	}
+}
+
+// WithDeadlineCheck compares the `retry.MaxTotalDuration()` of the back off with the time
+// remaining before the deadline of the context before the first attempt. If the back off
+// could never reach its attempts before the deadline a warning is logged via the logger
+// provided by `retry.WithLogger()`. If `strict` is true the retry instead fails immediately
+// with a `retry.Err` with Reason `retry.Misconfigured`. Back offs which are unbounded or do
+// not report a total duration are not checked.
+func WithDeadlineCheck(strict bool) Option {
+	return func(o *options) {
+		o.deadlineCheck = true
+		o.deadlineStrict = strict
+	}
+}
+
+// WithFaultInjector is a testing aid which overrides the outcome of attempts, it should not
+// be used outside of tests. After each attempt `inject` is called with the attempt number, the
+// error it returns replaces the error returned by the attempt, a nil error forces the attempt to
+// succeed. Return `ErrNoFault` to keep the outcome of the attempt. The attempt is always called
+// such that any side effects still happen.
+func WithFaultInjector(inject func(attempt int) error) Option {
+	return func(o *options) {
+		o.faultInjector = inject
+	}
+}
+
+// WithSuccessCondition checks `cond` after each attempt which returned no error, if it
+// returns false the attempt is treated as a failure with the error `ErrNotDone` and retried
+// like any other failure. This is useful when success depends on more than the error of the
+// attempt, unlike `retry.Poll()` the attempt itself still reports success with a nil error.
+func WithSuccessCondition(cond func(attempt int) bool) Option {
+	return func(o *options) {
+		o.successCondition = cond
+	}
+}
@@ -0,0 +1,752 @@
+package retry_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/mailgun/holster/v3/retry"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	errNetwork     = errors.New("connection refused")
+	errRateLimited = errors.New("rate limited")
+	errPermission  = errors.New("permission denied")
+)
+
+func isNetwork(err error) bool     { return errors.Is(err, errNetwork) }
+func isRateLimited(err error) bool { return errors.Is(err, errRateLimited) }
+func never(error) bool             { panic("should have short circuited") }
+
+func TestWithRetryIf(t *testing.T) {
+	errs := []error{errNetwork, errRateLimited, errPermission, errNetwork}
+	err := retry.Until(context.Background(), retry.Attempts(10, time.Millisecond),
+		func(ctx context.Context, att int) error {
+			return errs[att-1]
+		}, retry.WithRetryIf(retry.AnyOf(isNetwork, isRateLimited)))
+
+	require.Error(t, err)
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, 3, retryErr.Attempts)
+	assert.Equal(t, retry.Stopped, retryErr.Reason)
+	assert.Equal(t, errPermission, errors.Cause(err))
+}
+
+func TestAnyOf(t *testing.T) {
+	assert.True(t, retry.AnyOf(isNetwork, never)(errNetwork))
+	assert.True(t, retry.AnyOf(isRateLimited, isNetwork)(errNetwork))
+	assert.False(t, retry.AnyOf(isRateLimited, isNetwork)(errPermission))
+	assert.False(t, retry.AnyOf()(errNetwork))
+}
+
+func TestAllOf(t *testing.T) {
+	assert.False(t, retry.AllOf(isRateLimited, never)(errNetwork))
+	assert.True(t, retry.AllOf(isNetwork, isNetwork)(errNetwork))
+	assert.False(t, retry.AllOf(isNetwork, isRateLimited)(errNetwork))
+	assert.True(t, retry.AllOf()(errNetwork))
+}
+
+func TestWithName(t *testing.T) {
+	err := retry.Until(context.Background(), retry.Attempts(3, time.Millisecond),
+		func(ctx context.Context, att int) error {
+			return errNetwork
+		}, retry.WithName("fetch-user"))
+
+	require.Error(t, err)
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, "fetch-user", retryErr.Name)
+	assert.Equal(t, "operation 'fetch-user' on attempt '3'; attempts exhausted: connection refused", err.Error())
+}
+
+func TestWithSetup(t *testing.T) {
+	var events []string
+	err := retry.Until(context.Background(), retry.Attempts(5, time.Millisecond),
+		func(ctx context.Context, att int) error {
+			events = append(events, fmt.Sprintf("attempt-%d", att))
+			if att < 3 {
+				return errNetwork
+			}
+			return nil
+		}, retry.WithSetup(func(att int) (func(), error) {
+			events = append(events, fmt.Sprintf("setup-%d", att))
+			if att == 2 {
+				return nil, errPermission
+			}
+			return func() { events = append(events, fmt.Sprintf("cleanup-%d", att)) }, nil
+		}))
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"setup-1", "attempt-1", "cleanup-1",
+		// Failed setup counts as a failed attempt
+		"setup-2",
+		"setup-3", "attempt-3", "cleanup-3",
+	}, events)
+}
+
+func TestWithSetupCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var cleanedUp, called bool
+	err := retry.Until(ctx, retry.Interval(time.Millisecond),
+		func(ctx context.Context, att int) error {
+			called = true
+			return nil
+		}, retry.WithSetup(func(att int) (func(), error) {
+			// Context is cancelled between setup and the callback
+			cancel()
+			return func() { cleanedUp = true }, nil
+		}))
+
+	require.Error(t, err)
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, retry.Cancelled, retryErr.Reason)
+	assert.False(t, called)
+	assert.True(t, cleanedUp)
+}
+
+func TestWithOnRetry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	var infos []retry.RetryInfo
+	_ = retry.Until(ctx, retry.Interval(time.Millisecond*30), func(ctx context.Context, att int) error {
+		return errNetwork
+	}, retry.WithOnRetry(func(info retry.RetryInfo) {
+		infos = append(infos, info)
+	}))
+
+	require.Len(t, infos, 2)
+	assert.Equal(t, 1, infos[0].Attempt)
+	assert.Equal(t, errNetwork, infos[0].Err)
+	assert.Equal(t, time.Millisecond*30, infos[0].Interval)
+	assert.True(t, infos[0].Slept >= time.Millisecond*30)
+
+	// The second sleep is cut short by the context deadline
+	assert.Equal(t, 2, infos[1].Attempt)
+	assert.Equal(t, time.Millisecond*30, infos[1].Interval)
+	assert.True(t, infos[1].Slept < time.Millisecond*30, "slept %s", infos[1].Slept)
+}
+
+func TestWithInitialDelay(t *testing.T) {
+	start := time.Now()
+	var first time.Duration
+	err := retry.Until(context.Background(), retry.Attempts(2, time.Millisecond), func(ctx context.Context, att int) error {
+		if att == 1 {
+			first = time.Since(start)
+		}
+		return nil
+	}, retry.WithInitialDelay(time.Millisecond*20, time.Millisecond*40))
+
+	require.NoError(t, err)
+	assert.True(t, first >= time.Millisecond*20, "first attempt after %s", first)
+
+	// Zero delay is skipped
+	start = time.Now()
+	err = retry.Until(context.Background(), retry.Attempts(2, time.Millisecond), func(ctx context.Context, att int) error {
+		first = time.Since(start)
+		return nil
+	}, retry.WithInitialDelay(0, 0))
+	require.NoError(t, err)
+	assert.True(t, first < time.Millisecond*10, "first attempt after %s", first)
+}
+
+func TestWithInitialDelayCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	var called bool
+	err := retry.Until(ctx, retry.Attempts(2, time.Millisecond), func(ctx context.Context, att int) error {
+		called = true
+		return nil
+	}, retry.WithInitialDelay(time.Second, time.Second))
+
+	require.Error(t, err)
+	assert.False(t, called)
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, retry.Cancelled, retryErr.Reason)
+	assert.Equal(t, 0, retryErr.Attempts)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+}
+
+// attemptWithTimeout simulates an attempt which makes a call with its own timeout
+func attemptWithTimeout(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestTreatDeadlineAsFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	err := retry.Until(ctx, retry.Attempts(5, time.Millisecond), func(ctx context.Context, att int) error {
+		if att < 3 {
+			return attemptWithTimeout(ctx)
+		}
+		return nil
+	})
+	// The attempt's own timeout is retried, not confused with our context
+	require.NoError(t, err)
+
+	err = retry.Until(ctx, retry.Attempts(5, time.Millisecond), func(ctx context.Context, att int) error {
+		return attemptWithTimeout(ctx)
+	}, retry.TreatDeadlineAsFailure(false))
+
+	require.Error(t, err)
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, 1, retryErr.Attempts)
+	assert.Equal(t, retry.Stopped, retryErr.Reason)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+}
+
+func TestOuterDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	err := retry.Until(ctx, retry.Attempts(2, time.Millisecond), func(ctx context.Context, att int) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, retry.TreatDeadlineAsFailure(false))
+
+	// Our own deadline always reports cancelled, even when the back off would also exhaust
+	require.Error(t, err)
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, 1, retryErr.Attempts)
+	assert.Equal(t, retry.Cancelled, retryErr.Reason)
+}
+
+func TestWithAttemptJitter(t *testing.T) {
+	// A fixed seed makes the chosen caps repeatable
+	r := rand.New(rand.NewSource(42))
+
+	caps := make(map[int]bool)
+	for i := 0; i < 50; i++ {
+		var attempts int
+		err := retry.Until(context.Background(), retry.Interval(0), func(ctx context.Context, att int) error {
+			attempts = att
+			return errCause
+		}, retry.WithAttemptJitter(2, 5), retry.WithRand(r))
+
+		var retryErr *retry.Err
+		require.True(t, errors.As(err, &retryErr))
+		assert.Equal(t, retry.AttemptsExhausted, retryErr.Reason)
+		assert.Equal(t, attempts, retryErr.Attempts)
+		assert.True(t, attempts >= 2 && attempts <= 5, "attempts %d outside of range", attempts)
+		caps[attempts] = true
+	}
+
+	// Every cap in the range was chosen at least once
+	assert.Equal(t, map[int]bool{2: true, 3: true, 4: true, 5: true}, caps)
+}
+
+func TestWithAttemptJitterBackOffLimit(t *testing.T) {
+	// The back off still stops the retry before the jittered cap is reached
+	var attempts int
+	err := retry.Until(context.Background(), retry.Attempts(2, 0), func(ctx context.Context, att int) error {
+		attempts = att
+		return errCause
+	}, retry.WithAttemptJitter(5, 10))
+
+	require.Error(t, err)
+	assert.Equal(t, 2, attempts)
+}
+
+// fakeBreaker opens after `threshold` consecutive failures, once `halfOpen` is
+// set it allows a single probe which closes the breaker if it succeeds
+type fakeBreaker struct {
+	threshold int
+	failures  int
+	open      bool
+	halfOpen  bool
+	probing   bool
+	calls     []string
+}
+
+func (b *fakeBreaker) Allow() bool {
+	switch {
+	case b.halfOpen && !b.probing:
+		b.probing = true
+		b.calls = append(b.calls, "probe")
+		return true
+	case b.open:
+		b.calls = append(b.calls, "deny")
+		return false
+	}
+	b.calls = append(b.calls, "allow")
+	return true
+}
+
+func (b *fakeBreaker) Success() {
+	b.calls = append(b.calls, "success")
+	b.failures, b.open, b.halfOpen, b.probing = 0, false, false, false
+}
+
+func (b *fakeBreaker) Failure() {
+	b.calls = append(b.calls, "failure")
+	b.failures++
+	b.halfOpen, b.probing = false, false
+	if b.failures >= b.threshold {
+		b.open = true
+	}
+}
+
+func TestWithCircuitBreakerOpens(t *testing.T) {
+	cb := &fakeBreaker{threshold: 2}
+	err := retry.Until(context.Background(), retry.Attempts(10, time.Millisecond), func(ctx context.Context, att int) error {
+		return errCause
+	}, retry.WithCircuitBreaker(cb))
+
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, retry.CircuitOpen, retryErr.Reason)
+	assert.Equal(t, 2, retryErr.Attempts)
+	assert.True(t, errors.Is(err, retry.ErrCircuitOpen))
+	assert.Equal(t, []string{"allow", "failure", "allow", "failure", "deny"}, cb.calls)
+
+	// An open breaker fails fast without attempting
+	var called bool
+	err = retry.Until(context.Background(), retry.Attempts(10, time.Millisecond), func(ctx context.Context, att int) error {
+		called = true
+		return nil
+	}, retry.WithCircuitBreaker(cb))
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, retry.CircuitOpen, retryErr.Reason)
+	assert.Equal(t, 0, retryErr.Attempts)
+	assert.False(t, called)
+}
+
+func TestWithCircuitBreakerHalfOpen(t *testing.T) {
+	cb := &fakeBreaker{threshold: 1, open: true, halfOpen: true}
+
+	// A failed probe opens the breaker again
+	err := retry.Until(context.Background(), retry.Attempts(10, time.Millisecond), func(ctx context.Context, att int) error {
+		return errCause
+	}, retry.WithCircuitBreaker(cb))
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, retry.CircuitOpen, retryErr.Reason)
+	assert.Equal(t, 1, retryErr.Attempts)
+	assert.Equal(t, []string{"probe", "failure", "deny"}, cb.calls)
+
+	// A successful probe closes the breaker
+	cb.halfOpen, cb.calls = true, nil
+	err = retry.Until(context.Background(), retry.Attempts(10, time.Millisecond), func(ctx context.Context, att int) error {
+		return nil
+	}, retry.WithCircuitBreaker(cb))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"probe", "success"}, cb.calls)
+	assert.False(t, cb.open)
+}
+
+func TestWithCircuitBreakerClosed(t *testing.T) {
+	cb := &fakeBreaker{threshold: 5}
+	err := retry.Until(context.Background(), retry.Attempts(10, time.Millisecond), func(ctx context.Context, att int) error {
+		if att < 3 {
+			return errCause
+		}
+		return nil
+	}, retry.WithCircuitBreaker(cb))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"allow", "failure", "allow", "failure", "allow", "success"}, cb.calls)
+	assert.Equal(t, 0, cb.failures)
+}
+
+func TestWithCircuitBreakerNotDone(t *testing.T) {
+	cb := &fakeBreaker{threshold: 1}
+	err := retry.Poll(context.Background(), retry.Attempts(10, time.Millisecond), func(ctx context.Context, att int) (bool, error) {
+		return att == 3, nil
+	}, retry.WithCircuitBreaker(cb))
+	require.NoError(t, err)
+
+	// A poll which is not ready yet never opens the breaker
+	assert.Equal(t, []string{"allow", "success", "allow", "success", "allow", "success"}, cb.calls)
+	assert.False(t, cb.open)
+}
+
+type spanKey struct{}
+
+type fakeSpan struct {
+	attempt int
+	err     error
+	ended   bool
+}
+
+// fakeTracer records a span for every attempt
+type fakeTracer struct {
+	spans []*fakeSpan
+}
+
+func (tr *fakeTracer) StartAttempt(ctx context.Context, attempt int) (context.Context, func(error)) {
+	span := &fakeSpan{attempt: attempt}
+	tr.spans = append(tr.spans, span)
+	return context.WithValue(ctx, spanKey{}, span), func(err error) {
+		span.err = err
+		span.ended = true
+	}
+}
+
+func TestWithTracer(t *testing.T) {
+	tracer := &fakeTracer{}
+	err := retry.Until(context.Background(), retry.Attempts(5, time.Millisecond), func(ctx context.Context, att int) error {
+		// The attempt runs within its span
+		span, ok := ctx.Value(spanKey{}).(*fakeSpan)
+		require.True(t, ok)
+		assert.Equal(t, att, span.attempt)
+		assert.False(t, span.ended)
+
+		switch att {
+		case 1:
+			return errCause
+		case 2:
+			panic("boom")
+		}
+		return nil
+	}, retry.WithTracer(tracer), retry.WithRecover())
+	require.NoError(t, err)
+
+	require.Len(t, tracer.spans, 3)
+	for i, span := range tracer.spans {
+		assert.Equal(t, i+1, span.attempt)
+		assert.True(t, span.ended)
+	}
+	assert.Equal(t, errCause, tracer.spans[0].err)
+	assert.True(t, errors.Is(tracer.spans[1].err, retry.ErrPanic))
+	assert.Nil(t, tracer.spans[2].err)
+}
+
+func TestWithDeadlineClamp(t *testing.T) {
+	run := func(opts ...retry.Option) (*retry.Err, []int) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*150)
+		defer cancel()
+
+		var attempts []int
+		err := retry.Until(ctx, retry.Attempts(3, time.Millisecond*100), func(ctx context.Context, att int) error {
+			attempts = append(attempts, att)
+			return errCause
+		}, opts...)
+
+		var retryErr *retry.Err
+		require.True(t, errors.As(err, &retryErr))
+		return retryErr, attempts
+	}
+
+	// Without the clamp the second sleep overruns the deadline and the final attempt is lost
+	retryErr, attempts := run()
+	assert.Equal(t, retry.Cancelled, retryErr.Reason)
+	assert.Equal(t, []int{1, 2}, attempts)
+
+	// With the clamp the final attempt runs before the deadline and the attempts are exhausted
+	var infos []retry.RetryInfo
+	retryErr, attempts = run(retry.WithDeadlineClamp(time.Millisecond*20), retry.WithOnRetry(func(info retry.RetryInfo) {
+		infos = append(infos, info)
+	}))
+	assert.Equal(t, retry.AttemptsExhausted, retryErr.Reason)
+	assert.Equal(t, []int{1, 2, 3}, attempts)
+
+	// The interval of the back off is reported unchanged, only the wait is clamped
+	require.Len(t, infos, 2)
+	assert.Equal(t, time.Millisecond*100, infos[0].Interval)
+	assert.Equal(t, time.Millisecond*100, infos[0].Wait)
+	assert.Equal(t, time.Millisecond*100, infos[1].Interval)
+	assert.True(t, infos[1].Wait < time.Millisecond*100, "wait %s", infos[1].Wait)
+}
+
+func TestWithDeadlineClampUnbounded(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*150)
+	defer cancel()
+
+	// Once within the margin of the deadline the retry sleeps normally instead of spinning
+	var attempts int
+	err := retry.Until(ctx, retry.Interval(time.Millisecond*100), func(ctx context.Context, att int) error {
+		attempts = att
+		return errCause
+	}, retry.WithDeadlineClamp(time.Millisecond*20))
+
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, retry.Cancelled, retryErr.Reason)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestWithDeadlineCheck(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	// Ten attempts can sleep for 900ms which never fits within the deadline
+	err := retry.Until(ctx, retry.Attempts(10, time.Millisecond*100), func(ctx context.Context, att int) error {
+		return nil
+	}, retry.WithDeadlineCheck(false), retry.WithLogger(logger), retry.WithName("fetch"))
+	require.NoError(t, err)
+
+	require.Len(t, hook.AllEntries(), 1)
+	entry := hook.LastEntry()
+	assert.Equal(t, logrus.WarnLevel, entry.Level)
+	assert.Equal(t, "fetch", entry.Data["name"])
+	assert.Contains(t, entry.Message, "back off may sleep for '900ms' which exceeds the")
+
+	// A back off which fits within the deadline is not reported
+	hook.Reset()
+	err = retry.Until(ctx, retry.Attempts(3, time.Millisecond), func(ctx context.Context, att int) error {
+		return nil
+	}, retry.WithDeadlineCheck(false), retry.WithLogger(logger))
+	require.NoError(t, err)
+	assert.Empty(t, hook.AllEntries())
+}
+
+func TestWithDeadlineCheckStrict(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	var called bool
+	err := retry.Until(ctx, retry.Attempts(10, time.Millisecond*100), func(ctx context.Context, att int) error {
+		called = true
+		return nil
+	}, retry.WithDeadlineCheck(true))
+
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, retry.Misconfigured, retryErr.Reason)
+	assert.Equal(t, 0, retryErr.Attempts)
+	assert.True(t, errors.Is(err, retry.ErrMisconfigured))
+	assert.False(t, called)
+
+	// Without a deadline there is nothing to check
+	err = retry.Until(context.Background(), retry.Attempts(2, time.Millisecond*100), func(ctx context.Context, att int) error {
+		return nil
+	}, retry.WithDeadlineCheck(true))
+	require.NoError(t, err)
+}
+
+func TestWithOnSuccess(t *testing.T) {
+	fc := retry.NewFakeClock(time.Now())
+	go func() {
+		for fc.Wait4Scheduled(1, time.Second) {
+			fc.Advance(time.Second * 10)
+		}
+	}()
+
+	var info retry.SuccessInfo
+	var calls int
+	err := retry.Until(context.Background(), retry.Attempts(5, time.Second*10), func(ctx context.Context, att int) error {
+		// Each attempt takes a second of work
+		fc.Advance(time.Second)
+		if att < 3 {
+			return errCause
+		}
+		return nil
+	}, retry.WithClock(fc), retry.WithInitialDelay(time.Second*10, time.Second*10), retry.WithOnSuccess(func(i retry.SuccessInfo) {
+		info = i
+		calls++
+	}))
+	require.NoError(t, err)
+
+	// An initial delay of 10s, then an attempt of 1s followed by a sleep of 10s
+	// per failure, the third attempt starts at 32s and completes at 33s
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, retry.SuccessInfo{
+		Attempt:            3,
+		TimeToFirstAttempt: time.Second * 10,
+		TimeToSuccess:      time.Second * 32,
+		TotalElapsed:       time.Second * 33,
+	}, info)
+
+	// Not called when the retry fails
+	calls = 0
+	err = retry.Until(context.Background(), retry.Attempts(2, time.Millisecond), func(ctx context.Context, att int) error {
+		return errCause
+	}, retry.WithOnSuccess(func(i retry.SuccessInfo) { calls++ }))
+	require.Error(t, err)
+	assert.Equal(t, 0, calls)
+}
+
+func TestWithFaultInjector(t *testing.T) {
+	var called []int
+	err := retry.Until(context.Background(), retry.Attempts(5, time.Millisecond), func(ctx context.Context, att int) error {
+		called = append(called, att)
+		return nil
+	}, retry.WithFaultInjector(func(att int) error {
+		// Fail, fail, succeed
+		if att < 3 {
+			return errNetwork
+		}
+		return retry.ErrNoFault
+	}))
+	require.NoError(t, err)
+
+	// The attempt is called every time, even when its outcome is replaced
+	assert.Equal(t, []int{1, 2, 3}, called)
+}
+
+func TestWithFaultInjectorForceSuccess(t *testing.T) {
+	var attempts int
+	err := retry.Until(context.Background(), retry.Attempts(5, time.Millisecond), func(ctx context.Context, att int) error {
+		attempts = att
+		return errCause
+	}, retry.WithFaultInjector(func(att int) error {
+		if att == 2 {
+			return nil
+		}
+		return retry.ErrNoFault
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+}
+
+func TestStopOnErrorChange(t *testing.T) {
+	var prevs, curs []error
+	var attempts int
+	err := retry.Until(context.Background(), retry.Attempts(10, time.Millisecond), func(ctx context.Context, att int) error {
+		attempts = att
+		if att < 3 {
+			return errNetwork
+		}
+		return errPermission
+	}, retry.StopOnErrorChange(func(prev, cur error) bool {
+		prevs, curs = append(prevs, prev), append(curs, cur)
+		return prev != cur
+	}))
+
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, retry.ErrorChanged, retryErr.Reason)
+	assert.Equal(t, 3, retryErr.Attempts)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, errPermission, retryErr.Err)
+
+	// Only consecutive errors are compared, the first error has nothing to compare with
+	assert.Equal(t, []error{errNetwork, errNetwork}, prevs)
+	assert.Equal(t, []error{errNetwork, errPermission}, curs)
+}
+
+func TestWithOnExhausted(t *testing.T) {
+	type call struct {
+		err      error
+		attempts int
+	}
+	var calls []call
+	onExhausted := retry.WithOnExhausted(func(lastErr error, attempts int) {
+		calls = append(calls, call{err: lastErr, attempts: attempts})
+	})
+
+	err := retry.Until(context.Background(), retry.Attempts(3, time.Millisecond), func(ctx context.Context, att int) error {
+		if att == 3 {
+			return errPermission
+		}
+		return errNetwork
+	}, onExhausted)
+	require.Error(t, err)
+	assert.Equal(t, []call{{err: errPermission, attempts: 3}}, calls)
+
+	// Not called on success, stop or cancellation
+	calls = nil
+	_ = retry.Until(context.Background(), retry.Attempts(3, time.Millisecond), func(ctx context.Context, att int) error {
+		return nil
+	}, onExhausted)
+	_ = retry.Until(context.Background(), retry.Attempts(3, time.Millisecond), func(ctx context.Context, att int) error {
+		return retry.Stop(errCause)
+	}, onExhausted)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = retry.Until(ctx, retry.Attempts(3, time.Millisecond), func(ctx context.Context, att int) error {
+		return errCause
+	}, onExhausted)
+	assert.Empty(t, calls)
+}
+
+func TestWithOnCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	var calls int
+	var lastErr error
+	var attempts int
+	fn := func(err error, att int) {
+		calls++
+		lastErr, attempts = err, att
+	}
+	err := retry.Until(ctx, retry.Interval(time.Millisecond*20), func(ctx context.Context, att int) error {
+		return errCause
+	}, retry.WithOnExhausted(fn), retry.WithOnCancelled(fn))
+
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, retry.Cancelled, retryErr.Reason)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, errCause, lastErr)
+	assert.Equal(t, retryErr.Attempts, attempts)
+}
+
+func TestWithAttemptTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	outer, _ := ctx.Deadline()
+
+	// The attempt timeout is sooner than the deadline of the context
+	err := retry.Until(ctx, retry.Attempts(3, time.Millisecond), func(ctx context.Context, att int) error {
+		deadline, ok := ctx.Deadline()
+		require.True(t, ok)
+		assert.True(t, deadline.Before(outer))
+		assert.WithinDuration(t, time.Now().Add(time.Millisecond*100), deadline, time.Millisecond*20)
+
+		// A slow attempt is cut short and retried
+		if att == 1 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}, retry.WithAttemptTimeout(time.Millisecond*100))
+	require.NoError(t, err)
+
+	// The deadline of the context is sooner than the attempt timeout
+	err = retry.Until(ctx, retry.Attempts(3, time.Millisecond), func(ctx context.Context, att int) error {
+		deadline, ok := ctx.Deadline()
+		require.True(t, ok)
+		assert.Equal(t, outer, deadline)
+		return nil
+	}, retry.WithAttemptTimeout(time.Hour))
+	require.NoError(t, err)
+}
+
+func TestWithSuccessCondition(t *testing.T) {
+	var infos []retry.RetryInfo
+	var attempts int
+	err := retry.Until(context.Background(), retry.Attempts(5, time.Millisecond), func(ctx context.Context, att int) error {
+		attempts = att
+		return nil
+	}, retry.WithSuccessCondition(func(att int) bool {
+		return att > 2
+	}), retry.WithOnRetry(func(info retry.RetryInfo) {
+		infos = append(infos, info)
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	// The unmet condition is retried as a failure
+	require.Len(t, infos, 2)
+	assert.Equal(t, retry.ErrNotDone, infos[0].Err)
+	assert.Equal(t, retry.ErrNotDone, infos[1].Err)
+
+	// A condition which is never met exhausts the attempts
+	err = retry.Until(context.Background(), retry.Attempts(3, time.Millisecond), func(ctx context.Context, att int) error {
+		return nil
+	}, retry.WithSuccessCondition(func(att int) bool { return false }))
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, retry.AttemptsExhausted, retryErr.Reason)
+	assert.Equal(t, retry.ErrNotDone, retryErr.Err)
+}
@@ -0,0 +1,55 @@
+package retry
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Race retries each of the provided functions concurrently, each with its own copy of
+// `backOff` created via `BackOff.New()`. The first function to succeed wins, Race then
+// cancels the context of the remaining retries, waits for them to return and returns nil.
+// This is useful when making the same request to redundant endpoints.
+//
+// If every retry fails the returned error is a `retry.Errs` with the `retry.Err` of each
+// function in the order the functions were provided. Race with no functions returns nil.
+func Race(ctx context.Context, backOff BackOff, fns ...Func) error {
+	if len(fns) == 0 {
+		return nil
+	}
+	// Report a nil back off the same way Until does instead of panicking in `New()`
+	if backOff == nil {
+		return Until(ctx, nil, fns[0])
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var won bool
+	errs := make(Errs, len(fns))
+
+	for i, f := range fns {
+		wg.Add(1)
+		go func(i int, f Func) {
+			defer wg.Done()
+			bo := backOff.New()
+			bo.Reset()
+			if err := Until(ctx, bo, f); err != nil {
+				errors.As(err, &errs[i])
+				return
+			}
+			once.Do(func() {
+				won = true
+				cancel()
+			})
+		}(i, f)
+	}
+	wg.Wait()
+
+	if won {
+		return nil
+	}
+	return errs
+}
@@ -0,0 +1,75 @@
+package retry_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mailgun/holster/v3/retry"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRaceFirstSuccessWins(t *testing.T) {
+	failing := func(ctx context.Context, att int) error {
+		return errCause
+	}
+
+	start := time.Now()
+	err := retry.Race(context.Background(), retry.Interval(time.Millisecond*5),
+		failing,
+		func(ctx context.Context, att int) error {
+			// Succeeds on the third attempt
+			if att < 3 {
+				return errCause
+			}
+			return nil
+		},
+		failing,
+	)
+	require.NoError(t, err)
+
+	// The losing retries are unbounded and only return because Race cancelled them
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestRaceAllFail(t *testing.T) {
+	errA := errors.New("endpoint a down")
+	errB := errors.New("endpoint b down")
+
+	err := retry.Race(context.Background(), retry.Attempts(3, time.Millisecond),
+		func(ctx context.Context, att int) error { return errA },
+		func(ctx context.Context, att int) error { return errB },
+	)
+	require.Error(t, err)
+	assert.Equal(t, "2 retries failed: "+
+		"on attempt '3'; attempts exhausted: endpoint a down; "+
+		"on attempt '3'; attempts exhausted: endpoint b down", err.Error())
+
+	var errs retry.Errs
+	require.True(t, errors.As(err, &errs))
+	require.Len(t, errs, 2)
+	assert.Equal(t, errA, errs[0].Err)
+	assert.Equal(t, errB, errs[1].Err)
+}
+
+func TestRaceBackOffPerFunction(t *testing.T) {
+	var attempts int32
+	backOff := retry.Attempts(2, time.Millisecond)
+
+	err := retry.Race(context.Background(), backOff,
+		func(ctx context.Context, att int) error { atomic.AddInt32(&attempts, 1); return errCause },
+		func(ctx context.Context, att int) error { atomic.AddInt32(&attempts, 1); return errCause },
+	)
+	require.Error(t, err)
+
+	// Each function gets its own copy of the back off and all its attempts
+	assert.Equal(t, int32(4), atomic.LoadInt32(&attempts))
+	assert.Equal(t, 0, backOff.NumRetries())
+}
+
+func TestRaceNoFunctions(t *testing.T) {
+	assert.NoError(t, retry.Race(context.Background(), retry.Attempts(2, time.Millisecond)))
+}
@@ -0,0 +1,76 @@
+package retry
+
+import (
+	"sync"
+	"time"
+)
+
+// Recorder captures the intervals produced by a back off so tests can
+// assert on the retry schedule without inspecting real sleeps
+type Recorder struct {
+	mutex     sync.Mutex
+	intervals []time.Duration
+}
+
+// Intervals returns a copy of the intervals recorded so far in the order they were produced
+func (r *Recorder) Intervals() []time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]time.Duration(nil), r.intervals...)
+}
+
+// Reset discards all the recorded intervals
+func (r *Recorder) Reset() {
+	r.mutex.Lock()
+	r.intervals = nil
+	r.mutex.Unlock()
+}
+
+func (r *Recorder) record(d time.Duration) {
+	r.mutex.Lock()
+	r.intervals = append(r.intervals, d)
+	r.mutex.Unlock()
+}
+
+// RecordIntervals wraps the provided back off such that every interval it returns
+// which results in a retry is recorded by the returned Recorder. Back offs created
+// via `New()` on the returned back off record into the same Recorder.
+func RecordIntervals(b BackOff) (*Recorder, BackOff) {
+	r := &Recorder{}
+	return r, &recordBackOff{BackOff: b, recorder: r}
+}
+
+type recordBackOff struct {
+	BackOff
+	recorder *Recorder
+}
+
+func (b *recordBackOff) Next() (time.Duration, bool) {
+	interval, retry := b.BackOff.Next()
+	if retry {
+		b.recorder.record(interval)
+	}
+	return interval, retry
+}
+
+func (b *recordBackOff) New() BackOff {
+	return &recordBackOff{BackOff: b.BackOff.New(), recorder: b.recorder}
+}
+
+func (b *recordBackOff) Expired() bool {
+	if e, ok := b.BackOff.(expirer); ok {
+		return e.Expired()
+	}
+	return false
+}
+
+func (b *recordBackOff) Validate() error {
+	if v, ok := b.BackOff.(validator); ok {
+		return v.Validate()
+	}
+	return nil
+}
+
+func (b *recordBackOff) MaxTotalDuration() (time.Duration, bool) {
+	return MaxTotalDuration(b.BackOff)
+}
@@ -0,0 +1,48 @@
+package retry_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mailgun/holster/v3/retry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordIntervals(t *testing.T) {
+	rec, backOff := retry.RecordIntervals(&retry.ExponentialBackOff{
+		Min:      time.Millisecond,
+		Max:      time.Millisecond * 8,
+		Factor:   2,
+		Attempts: 5,
+	})
+
+	err := retry.Until(context.Background(), backOff, func(ctx context.Context, att int) error {
+		return errCause
+	})
+	require.Error(t, err)
+
+	intervals := rec.Intervals()
+	require.Len(t, intervals, 5)
+	for i, d := range intervals {
+		assert.True(t, d >= time.Millisecond && d <= time.Millisecond*8, "interval %s out of range", d)
+		if i > 0 {
+			assert.True(t, d >= intervals[i-1], "intervals are not monotonic %v", intervals)
+		}
+	}
+	assert.Equal(t, []time.Duration{
+		time.Millisecond * 2,
+		time.Millisecond * 4,
+		time.Millisecond * 8,
+		time.Millisecond * 8,
+		time.Millisecond * 8,
+	}, intervals)
+
+	// Back offs created from the recording back off share the recorder
+	rec.Reset()
+	bo := backOff.New()
+	bo.Reset()
+	bo.Next()
+	assert.Equal(t, []time.Duration{time.Millisecond * 2}, rec.Intervals())
+}
@@ -0,0 +1,94 @@
+package retry
+
+import (
+	"context"
+	"time"
+)
+
+// ResultFunc is the generic counterpart of `retry.Func` which returns a value on success
+type ResultFunc[T any] func(context.Context, int) (T, error)
+
+// UntilResult behaves exactly like `retry.Until` but returns the value produced by the
+// first successful attempt. On failure the zero value of T is returned, not a partial result
+// from a failed attempt, along with the same `*retry.Err` that `retry.Until` would return.
+func UntilResult[T any](ctx context.Context, backOff BackOff, f ResultFunc[T], opts ...Option) (T, error) {
+	var result T
+	if f == nil {
+		return result, Until(ctx, backOff, nil, opts...)
+	}
+	err := Until(ctx, backOff, func(ctx context.Context, att int) error {
+		v, err := f(ctx, att)
+		if err != nil {
+			return err
+		}
+		result = v
+		return nil
+	}, opts...)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return result, nil
+}
+
+// Result is the outcome of `retry.UntilResultMeta()`
+type Result[T any] struct {
+	// Value is the value returned by the successful attempt, the zero value on failure
+	Value T
+	// Attempts is the number of attempts made
+	Attempts int
+	// Elapsed is the time from the start of the retry until it returned
+	Elapsed time.Duration
+	// Err is the `*retry.Err` that `retry.Until` would return, nil on success
+	Err error
+}
+
+// UntilResultMeta behaves exactly like `retry.UntilResult` but returns the value along with
+// the number of attempts and the time elapsed in a single `retry.Result`, such that callers
+// need not inspect the error to learn how the retry went.
+func UntilResultMeta[T any](ctx context.Context, backOff BackOff, f ResultFunc[T], opts ...Option) Result[T] {
+	o := newOptions(opts)
+	start := o.clock.Now()
+
+	var r Result[T]
+	var fn Func
+	if f != nil {
+		fn = func(ctx context.Context, att int) error {
+			r.Attempts = att
+			v, err := f(ctx, att)
+			if err != nil {
+				return err
+			}
+			r.Value = v
+			return nil
+		}
+	}
+	if r.Err = until(ctx, backOff, fn, o); r.Err != nil {
+		var zero T
+		r.Value = zero
+	}
+	r.Elapsed = o.clock.Now().Sub(start)
+	return r
+}
+
+// StateFunc is the generic counterpart of `retry.Func` which is passed the state
+// returned by the previous attempt and returns the state for the next attempt
+type StateFunc[S any] func(ctx context.Context, attempt int, state S) (S, error)
+
+// UntilState behaves exactly like `retry.Until` but threads state between attempts, the
+// state returned by a failed attempt is passed to the next attempt allowing it to resume
+// any progress made. The first attempt is passed `initial`. On success the final state
+// is returned, on failure the state returned by the last attempt is returned along with
+// the same `*retry.Err` that `retry.Until` would return.
+func UntilState[S any](ctx context.Context, backOff BackOff, initial S, f StateFunc[S], opts ...Option) (S, error) {
+	state := initial
+	if f == nil {
+		return state, Until(ctx, backOff, nil, opts...)
+	}
+	err := Until(ctx, backOff, func(ctx context.Context, att int) error {
+		var err error
+		state, err = f(ctx, att, state)
+		return err
+	}, opts...)
+	return state, err
+}
@@ -0,0 +1,121 @@
+package retry_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mailgun/holster/v3/retry"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type resultValue struct {
+	Name string
+}
+
+func TestUntilResultInterval(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	v, err := retry.UntilResult(ctx, retry.Interval(time.Millisecond*10), func(ctx context.Context, att int) (*resultValue, error) {
+		// Partial results from failed attempts are never returned
+		return &resultValue{Name: "partial"}, errCause
+	})
+
+	require.Error(t, err)
+	assert.Nil(t, v)
+	assert.True(t, errors.Is(err, &retry.Err{}))
+
+	// Inspect the error
+	var retryErr *retry.Err
+	assert.True(t, errors.As(err, &retryErr))
+	assert.True(t, retryErr.Attempts > 1)
+	assert.Equal(t, retry.Cancelled, retryErr.Reason)
+
+	// Cause() works as expected
+	assert.Equal(t, errCause, errors.Cause(err))
+}
+
+func TestUntilResultSuccess(t *testing.T) {
+	ctx := context.Background()
+	v, err := retry.UntilResult(ctx, retry.Attempts(5, time.Millisecond), func(ctx context.Context, att int) (int, error) {
+		if att < 3 {
+			return 0, errCause
+		}
+		return att * 10, nil
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, 30, v)
+}
+
+func TestUntilStateResume(t *testing.T) {
+	const size, chunk = 100, 30
+	var offsets []int
+
+	// Each attempt uploads one chunk before the connection drops
+	offset, err := retry.UntilState(context.Background(), retry.Attempts(10, time.Millisecond), 0,
+		func(ctx context.Context, att int, offset int) (int, error) {
+			offsets = append(offsets, offset)
+			offset += chunk
+			if offset >= size {
+				return size, nil
+			}
+			return offset, errCause
+		})
+
+	require.NoError(t, err)
+	assert.Equal(t, size, offset)
+	assert.Equal(t, []int{0, 30, 60, 90}, offsets)
+}
+
+func TestUntilStateExhausted(t *testing.T) {
+	offset, err := retry.UntilState(context.Background(), retry.Attempts(3, time.Millisecond), 10,
+		func(ctx context.Context, att int, offset int) (int, error) {
+			return offset + 1, errCause
+		})
+
+	require.Error(t, err)
+	// The state from the last attempt is returned
+	assert.Equal(t, 13, offset)
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, 3, retryErr.Attempts)
+	assert.Equal(t, retry.AttemptsExhausted, retryErr.Reason)
+}
+
+func TestUntilResultMetaSuccess(t *testing.T) {
+	fc := retry.NewFakeClock(time.Now())
+	go func() {
+		for fc.Wait4Scheduled(1, time.Second) {
+			fc.Advance(time.Second)
+		}
+	}()
+
+	r := retry.UntilResultMeta(context.Background(), retry.Attempts(5, time.Second), func(ctx context.Context, att int) (*resultValue, error) {
+		if att < 3 {
+			return nil, errCause
+		}
+		return &resultValue{Name: "result"}, nil
+	}, retry.WithClock(fc))
+
+	require.NoError(t, r.Err)
+	assert.Equal(t, &resultValue{Name: "result"}, r.Value)
+	assert.Equal(t, 3, r.Attempts)
+	assert.Equal(t, 2*time.Second, r.Elapsed)
+}
+
+func TestUntilResultMetaFailure(t *testing.T) {
+	r := retry.UntilResultMeta(context.Background(), retry.Attempts(3, time.Millisecond), func(ctx context.Context, att int) (*resultValue, error) {
+		return &resultValue{Name: "partial"}, errCause
+	})
+
+	assert.Nil(t, r.Value)
+	assert.Equal(t, 3, r.Attempts)
+	assert.True(t, r.Elapsed >= 2*time.Millisecond)
+	var retryErr *retry.Err
+	require.True(t, errors.As(r.Err, &retryErr))
+	assert.Equal(t, retry.AttemptsExhausted, retryErr.Reason)
+	assert.Equal(t, 3, retryErr.Attempts)
+}
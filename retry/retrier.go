@@ -0,0 +1,27 @@
+package retry
+
+import "context"
+
+// Retrier applies the same options to every retry it runs, this allows cross cutting
+// behavior like logging, metrics or panic recovery to be configured once and reused.
+type Retrier struct {
+	opts []Option
+}
+
+// New returns a Retrier which applies the provided options to every retry
+//
+//	r := retry.New(retry.WithLogger(log), retry.WithMetrics(m), retry.WithRecover())
+//	err := r.Until(ctx, backOff, f)
+func New(opts ...Option) *Retrier {
+	return &Retrier{opts: opts}
+}
+
+// Until behaves exactly like `retry.Until()` with the options of the Retrier applied
+// first, options passed to Until are applied after and take precedence.
+func (r *Retrier) Until(ctx context.Context, backOff BackOff, f Func, opts ...Option) error {
+	o := newOptions(r.opts)
+	for _, opt := range opts {
+		opt(o)
+	}
+	return until(ctx, backOff, f, o)
+}
@@ -0,0 +1,84 @@
+package retry_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/holster/v3/retry"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeMetrics struct {
+	mutex    sync.Mutex
+	attempts []int
+	errs     []error
+	names    []string
+}
+
+func (m *fakeMetrics) ObserveAttempt(name string, attempt int, d time.Duration, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.names = append(m.names, name)
+	m.attempts = append(m.attempts, attempt)
+	m.errs = append(m.errs, err)
+}
+
+func TestRetrier(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	metrics := &fakeMetrics{}
+
+	r := retry.New(
+		retry.WithLogger(logger),
+		retry.WithMetrics(metrics),
+		retry.WithRecover(),
+	)
+
+	// The same retrier applies all its behaviors to every call
+	for i := 0; i < 2; i++ {
+		hook.Reset()
+		metrics.attempts = nil
+		metrics.errs = nil
+
+		err := r.Until(context.Background(), retry.Attempts(5, time.Millisecond), func(ctx context.Context, att int) error {
+			switch att {
+			case 1:
+				panic("boom")
+			case 2:
+				return errCause
+			}
+			return nil
+		})
+		require.NoError(t, err)
+
+		require.Len(t, hook.AllEntries(), 2)
+		entry := hook.AllEntries()[0]
+		assert.Equal(t, logrus.DebugLevel, entry.Level)
+		assert.Equal(t, 1, entry.Data["attempt"])
+		assert.True(t, errors.Is(entry.Data[logrus.ErrorKey].(error), retry.ErrPanic))
+		assert.Equal(t, errCause, hook.AllEntries()[1].Data[logrus.ErrorKey])
+
+		assert.Equal(t, []int{1, 2, 3}, metrics.attempts)
+		require.Len(t, metrics.errs, 3)
+		assert.Equal(t, "boom: panic during attempt", metrics.errs[0].Error())
+		assert.Equal(t, errCause, metrics.errs[1])
+		assert.Nil(t, metrics.errs[2])
+	}
+}
+
+func TestRetrierOptionPrecedence(t *testing.T) {
+	r := retry.New(retry.WithName("default"))
+	err := r.Until(context.Background(), retry.Attempts(1, time.Millisecond), func(ctx context.Context, att int) error {
+		return errCause
+	}, retry.WithName("override"))
+
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, "override", retryErr.Name)
+}
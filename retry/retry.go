@@ -2,24 +2,52 @@ package retry
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/mailgun/holster/v3/syncutil"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 const (
 	Cancelled         = cancelReason("context cancelled")
 	Stopped           = cancelReason("retry stopped")
 	AttemptsExhausted = cancelReason("attempts exhausted")
+	Expired           = cancelReason("max elapsed time exceeded")
+	Misconfigured     = cancelReason("misconfigured")
+	CircuitOpen       = cancelReason("circuit open")
+	CallerCancelled   = cancelReason("cancelled by caller")
+	ErrorChanged      = cancelReason("error changed")
 )
 
+// ErrMisconfigured is the cause of a `retry.Err` with Reason `retry.Misconfigured`
+var ErrMisconfigured = errors.New("misconfigured back off")
+
+// ErrCircuitOpen is the cause of a `retry.Err` with Reason `retry.CircuitOpen`
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
 type Func func(context.Context, int) error
 
 type cancelReason string
 
+func (r cancelReason) String() string { return string(r) }
+
+// expirer is implemented by back offs which may stop retrying due to a time limit
+// instead of the number of attempts
+type expirer interface {
+	Expired() bool
+}
+
+// validator is implemented by back offs which can detect a nonsensical configuration
+type validator interface {
+	Validate() error
+}
+
 type stopErr struct {
 	err error
 }
@@ -29,63 +57,406 @@ func (e *stopErr) Error() string {
 }
 
 type Err struct {
-	Err      error
-	Reason   cancelReason
+	// Name is the name of the operation provided via `retry.WithName()`
+	Name   string
+	Err    error
+	Reason cancelReason
+	// Attempts is the number of attempts made, it is a machine sized int which
+	// even at one attempt per nanosecond would take centuries to overflow
 	Attempts int
+	// Retried is true if the retry slept between attempts at least once, this
+	// distinguishes a retry which failed fast from one which backed off first
+	Retried bool
 }
 
-func (e *Err) Cause() error { return e.Err }
+func (e *Err) Cause() error  { return e.Err }
+func (e *Err) Unwrap() error { return e.Err }
 func (e *Err) Error() string {
+	if e.Name != "" {
+		return fmt.Sprintf("operation '%s' on attempt '%d'; %s: %s", e.Name, e.Attempts, e.Reason, e.Err.Error())
+	}
 	return fmt.Sprintf("on attempt '%d'; %s: %s", e.Attempts, e.Reason, e.Err.Error())
 }
 
+// MarshalJSON encodes the error as an object with the fields `attempts`, `reason` and
+// `cause`, where `cause` is the message of the underlying error. If the operation
+// was named via `retry.WithName()` the name is included as `name`.
+func (e *Err) MarshalJSON() ([]byte, error) {
+	j := struct {
+		Name     string `json:"name,omitempty"`
+		Attempts int    `json:"attempts"`
+		Reason   string `json:"reason"`
+		Cause    string `json:"cause"`
+	}{
+		Name:     e.Name,
+		Attempts: e.Attempts,
+		Reason:   e.Reason.String(),
+	}
+	if e.Err != nil {
+		j.Cause = e.Err.Error()
+	}
+	return json.Marshal(j)
+}
+
+// Clone returns a copy of the error which callers can modify without
+// affecting the original which might be shared with other goroutines
+func (e *Err) Clone() *Err {
+	c := *e
+	return &c
+}
+
+// Equal reports if both errors have the same Attempts and Reason. The cause takes
+// part only if `other.Err` is not nil, in which case it must match via `errors.Is()`.
+// Name and Retried are ignored such that tests need not match volatile details.
+func (e *Err) Equal(other *Err) bool {
+	if e == nil || other == nil {
+		return e == other
+	}
+	if e.Attempts != other.Attempts || e.Reason != other.Reason {
+		return false
+	}
+	if other.Err != nil {
+		return errors.Is(e.Err, other.Err)
+	}
+	return true
+}
+
+// Is reports if the target is a `*retry.Err` whose non zero Reason and Attempts match
+// this error, the zero value of each field matches anything such that
+// `errors.Is(err, &retry.Err{})` matches any `retry.Err` while
+// `errors.Is(err, &retry.Err{Reason: retry.Cancelled, Attempts: 19})` only matches a
+// retry which was cancelled on the 19th attempt. No other fields take part in matching.
 func (e *Err) Is(target error) bool {
-	_, ok := target.(*Err)
-	if !ok {
+	t, ok := target.(*Err)
+	if !ok || t == nil {
+		return false
+	}
+	if t.Reason != "" && t.Reason != e.Reason {
+		return false
+	}
+	if t.Attempts != 0 && t.Attempts != e.Attempts {
 		return false
 	}
 	return true
 }
 
+// Errs combines the errors of several retries into a single error, such as the errors
+// returned by `retry.Race()` when every retry failed. Both `errors.Is()` and `errors.As()`
+// match if any of the errors match, `Unwrap()` returns each of the errors.
+type Errs []*Err
+
+func (e Errs) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d retries failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns each of the errors, which `errors.Is()` and `errors.As()` walk from Go 1.20
+func (e Errs) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Is reports if any of the errors matches the target, for Go versions before 1.20
+// which do not walk the errors returned by `Unwrap() []error`
+func (e Errs) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors which matches the target, for Go versions before 1.20
+// which do not walk the errors returned by `Unwrap() []error`
+func (e Errs) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
 // Stop forces the retry to cancel with the provided error
 // and retry.Err.Reason == retry.Stopped
 func Stop(err error) error {
 	return &stopErr{err: err}
 }
 
+type sleepErr struct {
+	until time.Time
+	err   error
+}
+
+func (e *sleepErr) Error() string {
+	return fmt.Sprintf("sleep until '%s' err: %s", e.until.Format(time.RFC3339), e.err.Error())
+}
+
+// Sleep fails the attempt with the provided error and asks the retry to wait until
+// the provided time before the next attempt instead of the interval provided by the
+// back off. This is useful when a server reports the time a rate limit resets. The
+// attempt still counts towards the back off, if `until` is in the past the next attempt
+// is made immediately. The wait is cut short if the context is cancelled.
+func Sleep(until time.Time, err error) error {
+	return &sleepErr{until: until, err: err}
+}
+
 // Until will retry the provided `retry.Func` until it returns nil or
 // the context is cancelled. Optionally users may use `retry.Stop()` to force
 // the retry to terminate with an error. Returns a `retry.Err` with
 // the included Reason and Attempts
-func Until(ctx context.Context, backOff BackOff, f Func) error {
+//
+// The first attempt is always made immediately, the back off is only consulted
+// for the interval to sleep after an attempt fails. If the back off provides a
+// `Validate() error` method it is called before the first attempt, a back off which
+// fails validation returns a `retry.Err` with Reason `retry.Misconfigured` which
+// matches `errors.Is(err, retry.ErrMisconfigured)`. The same error is returned
+// instead of a panic if either the back off or `f` is nil.
+//
+// If the context is already done when Until is called no attempt is made and a
+// `retry.Err` with Reason `retry.Cancelled` and no attempts is returned.
+func Until(ctx context.Context, backOff BackOff, f Func, opts ...Option) error {
+	return until(ctx, backOff, f, newOptions(opts))
+}
+
+func until(ctx context.Context, backOff BackOff, f Func, o *options) error {
 	var attempt int
+	var retried bool
+	var start, firstAttempt time.Time
+	if o.onSuccess != nil {
+		start = o.clock.Now()
+	}
+	newErr := func(reason cancelReason, err error) error {
+		switch reason {
+		case AttemptsExhausted, Expired:
+			if o.onExhausted != nil {
+				o.onExhausted(err, attempt)
+			}
+		case Cancelled:
+			if o.onCancelled != nil {
+				o.onCancelled(err, attempt)
+			}
+		}
+		return &Err{Name: o.name, Attempts: attempt, Reason: reason, Err: err, Retried: retried}
+	}
+	if backOff == nil {
+		return newErr(Misconfigured, errors.Wrap(ErrMisconfigured, "back off is nil"))
+	}
+	if f == nil {
+		return newErr(Misconfigured, errors.Wrap(ErrMisconfigured, "retry.Func is nil"))
+	}
+	if v, ok := backOff.(validator); ok {
+		if err := v.Validate(); err != nil {
+			return newErr(Misconfigured, err)
+		}
+	}
+	// Don't make a doomed attempt if the caller has already given up
+	if err := ctx.Err(); err != nil {
+		return newErr(Cancelled, err)
+	}
+	if err := o.checkDeadline(ctx, backOff); err != nil {
+		if o.deadlineStrict {
+			return newErr(Misconfigured, errors.Wrap(ErrMisconfigured, err.Error()))
+		}
+		if o.logger != nil {
+			o.logger.WithField("name", o.name).Warn(err.Error())
+		}
+	}
+	if o.initialDelayMin > 0 || o.initialDelayMax > 0 {
+		if _, ok := o.sleep(ctx, o.initialDelay()); !ok {
+			return newErr(Cancelled, ctx.Err())
+		}
+	}
+	maxAttempts := o.maxAttempts()
+	var history []error
+	var prevErr error
 	for {
+		if o.breaker != nil && !o.breaker.Allow() {
+			return newErr(CircuitOpen, ErrCircuitOpen)
+		}
 		attempt++
-		if err := f(ctx, attempt); err != nil {
+		// Always replace the history of an enclosing retry, such that a nested retry
+		// never reports the errors of the outer retry as its own
+		actx := ctx
+		if len(history) != 0 || ErrorsFromContext(ctx) != nil {
+			actx = withErrors(ctx, append([]error(nil), history...))
+		}
+		var attemptStart time.Time
+		if o.onSuccess != nil {
+			attemptStart = o.clock.Now()
+			if attempt == 1 {
+				firstAttempt = attemptStart
+			}
+		}
+		err := o.attempt(actx, attempt, f)
+		if o.breaker != nil {
+			// Giving up because our context was cancelled says nothing about the health of the service,
+			// and an attempt which is merely not done yet got an answer from the service
+			if err == nil || errors.Is(err, ErrNotDone) {
+				o.breaker.Success()
+			} else if ctx.Err() == nil {
+				o.breaker.Failure()
+			}
+		}
+		if err != nil {
 			var stop *stopErr
 			if errors.As(err, &stop) {
-				return &Err{Attempts: attempt, Reason: Stopped, Err: stop.err}
+				return newErr(Stopped, stop.err)
+			}
+			var wakeAt time.Time
+			var sleep *sleepErr
+			if errors.As(err, &sleep) {
+				wakeAt, err = sleep.until, sleep.err
+			}
+			if o.errorHistory > 0 {
+				// Reuse the oldest slot once full, such that the history never grows past the cap
+				if len(history) == o.errorHistory {
+					copy(history, history[1:])
+					history[len(history)-1] = err
+				} else {
+					history = append(history, err)
+				}
+			}
+			// An error caused by the cancellation of our context is never retried
+			if ctx.Err() != nil {
+				return newErr(Cancelled, err)
+			}
+			// A deadline from a context created by the attempt is not our deadline
+			if !o.deadlineAsFailure && errors.Is(err, context.DeadlineExceeded) {
+				return newErr(Stopped, err)
+			}
+			if o.retryIf != nil && !o.retryIf(err) {
+				return newErr(Stopped, err)
+			}
+			if o.errorChanged != nil && prevErr != nil && o.errorChanged(prevErr, err) {
+				return newErr(ErrorChanged, err)
+			}
+			prevErr = err
+			if maxAttempts != 0 && attempt >= maxAttempts {
+				return newErr(AttemptsExhausted, err)
 			}
 			interval, retry := backOff.Next()
 			if !retry {
-				return &Err{Attempts: attempt, Reason: AttemptsExhausted, Err: err}
+				reason := AttemptsExhausted
+				if e, ok := backOff.(expirer); ok && e.Expired() {
+					reason = Expired
+				}
+				return newErr(reason, err)
 			}
-			timer := time.NewTimer(interval)
-			select {
-			case <-timer.C:
-				timer.Stop()
-				continue
-			case <-ctx.Done():
-				if !timer.Stop() {
-					<-timer.C
+			// The interval of the back off is reported as is, only the wait is adjusted
+			wait := interval
+			if !wakeAt.IsZero() {
+				wait = wakeAt.Sub(o.clock.Now())
+				if wait < 0 {
+					wait = 0
 				}
-				return &Err{Attempts: attempt, Reason: Cancelled, Err: err}
 			}
+			wait = o.clampToDeadline(ctx, wait)
+			if o.logger != nil {
+				o.logger.WithFields(logrus.Fields{
+					"name":     o.name,
+					"attempt":  attempt,
+					"interval": wait,
+				}).WithError(err).Debug("attempt failed; retrying")
+			}
+			slept, ok := o.sleep(ctx, wait)
+			retried = true
+			if o.onRetry != nil {
+				o.onRetry(RetryInfo{Attempt: attempt, Err: err, Interval: interval, Wait: wait, Slept: slept})
+			}
+			if !ok {
+				return newErr(Cancelled, err)
+			}
+			continue
+		}
+		if o.onSuccess != nil {
+			o.onSuccess(SuccessInfo{
+				Attempt:            attempt,
+				TimeToFirstAttempt: firstAttempt.Sub(start),
+				TimeToSuccess:      attemptStart.Sub(start),
+				TotalElapsed:       o.clock.Now().Sub(start),
+			})
+		}
+		return nil
+	}
+}
+
+// ErrNotDone is the cause reported when a condition was not met before the retry gave up
+var ErrNotDone = errors.New("condition not met")
+
+// PollFunc reports if the condition being polled for has been met
+type PollFunc func(context.Context, int) (bool, error)
+
+// Poll calls the provided `retry.PollFunc` until it reports done, even when it
+// returns no error. Poll returns nil once the function returns true, if the function
+// returns an error the poll is stopped and a `retry.Err` with the included error and
+// Reason `retry.Stopped` is returned. If the back off is exhausted or the context is
+// cancelled before the condition is met, the cause of the returned `retry.Err` is `ErrNotDone`.
+//
+// Use Poll when waiting for a resource to become ready, use Until when retrying
+// an operation until it no longer fails.
+func Poll(ctx context.Context, backOff BackOff, f PollFunc, opts ...Option) error {
+	if f == nil {
+		return Until(ctx, backOff, nil, opts...)
+	}
+	return Until(ctx, backOff, func(ctx context.Context, att int) error {
+		done, err := f(ctx, att)
+		if err != nil {
+			return Stop(err)
+		}
+		if !done {
+			return ErrNotDone
 		}
 		return nil
+	}, opts...)
+}
+
+// UntilTrue retries the provided predicate until it returns true, it behaves exactly like
+// `retry.Poll()` and exists for readability where the function is a predicate such as is
+// ready or is healthy. While the predicate returns false with no error the retry continues,
+// a non nil error stops the retry immediately with Reason `retry.Stopped`. Prefer Poll when
+// waiting for a resource to reach a state, UntilTrue when checking a condition.
+func UntilTrue(ctx context.Context, backOff BackOff, f PollFunc, opts ...Option) error {
+	return Poll(ctx, backOff, f, opts...)
+}
+
+// UntilConsecutive calls the provided `retry.Func` until it succeeds `k` consecutive
+// times, any failure resets the count of successes. The back off provides the interval
+// between every call, including between successes, and every call counts towards the
+// attempts of the back off. This is useful for a health check which must pass several
+// times in a row before it is trusted.
+//
+// If the back off is exhausted or the context is cancelled before `k` consecutive successes
+// a `retry.Err` is returned, its cause is the error of the last call or `ErrNotDone` if
+// the last call succeeded.
+func UntilConsecutive(ctx context.Context, backOff BackOff, k int, f Func, opts ...Option) error {
+	if f == nil {
+		return Until(ctx, backOff, nil, opts...)
 	}
+	var successes int
+	return Until(ctx, backOff, func(ctx context.Context, att int) error {
+		if err := f(ctx, att); err != nil {
+			successes = 0
+			return err
+		}
+		successes++
+		if successes < k {
+			return ErrNotDone
+		}
+		return nil
+	}, opts...)
 }
 
+// AsyncItem is a snapshot of the state of an async retry. Items returned by
+// `Async()` and `Errs()` are copies which are never modified by the retry, it
+// is safe to read them while the retry continues to run in the background.
 type AsyncItem struct {
 	Retrying bool
 	Attempts int
@@ -96,11 +467,45 @@ func (s *AsyncItem) Error() string {
 	return s.Err.Error()
 }
 
+type AsyncOptions struct {
+	// OnAttempt if provided is called after every failed attempt of every async retry with
+	// the key of the retry. It is called without holding any internal locks, so it is
+	// safe to call methods on `Async` from within the callback.
+	OnAttempt func(key interface{}, attempt int, err error)
+
+	// OnStart if provided is called when a new async retry is started in the background, either
+	// after the first attempt made by `Async()` fails or by `AsyncDelayed()` before any attempt
+	// is made. It is not called when the state of a retry which is already running is returned.
+	// Like OnAttempt it is called without holding any locks.
+	OnStart func(key interface{})
+
+	// OnFinish if provided is called exactly once for every retry started, when the background
+	// retry exits, with the last error returned by the function or nil if it succeeded.
+	// Like OnAttempt it is called without holding any locks.
+	OnFinish func(key interface{}, err error)
+
+	// Clock if provided is used to sleep between attempts, this allows async retries
+	// to share a time source with `retry.Until()` via `retry.WithClock()`
+	Clock Clock
+}
+
+// ErrAsyncClosed is the error reported by `Async()` once `Close()` has been called
+var ErrAsyncClosed = errors.New("async retry is closed")
+
 type Async struct {
-	asyncs map[interface{}]AsyncItem
-	mutex  *sync.Mutex
-	ctx    context.Context
-	wg     syncutil.WaitGroup
+	asyncs  map[interface{}]AsyncItem
+	mutex   *sync.Mutex
+	ctx     context.Context
+	wg      syncutil.WaitGroup
+	opts    AsyncOptions
+	closed  bool
+	cancels map[interface{}]*asyncCancel
+	times   map[interface{}]asyncTimes
+}
+
+// asyncTimes records when an async retry started and finished for `Snapshot()`
+type asyncTimes struct {
+	started, finished time.Time
 }
 
 // Given a function that takes a context, run the provided function; if it fails, retry the function asynchronously
@@ -110,11 +515,22 @@ type Async struct {
 //
 // The code assumes the caller will continue to call `Async()` until either the retries have exhausted or
 // an Async{Retrying: false} is returned.
-func NewRetryAsync() *Async {
-	return &Async{
-		mutex:  &sync.Mutex{},
-		asyncs: make(map[interface{}]AsyncItem),
+//
+// Optionally users may provide `AsyncOptions` to observe the retries.
+func NewRetryAsync(opts ...AsyncOptions) *Async {
+	s := &Async{
+		mutex:   &sync.Mutex{},
+		asyncs:  make(map[interface{}]AsyncItem),
+		cancels: make(map[interface{}]*asyncCancel),
+		times:   make(map[interface{}]asyncTimes),
+	}
+	if len(opts) != 0 {
+		s.opts = opts[0]
 	}
+	if s.opts.Clock == nil {
+		s.opts.Clock = defaultClock{}
+	}
+	return s
 }
 
 // Return the number of active async retries
@@ -134,42 +550,259 @@ func (s *Async) Wait() {
 	s.wg.Wait()
 }
 
-func (s *Async) Async(key interface{}, ctx context.Context, bo BackOff,
-	f func(context.Context, int) error) *AsyncItem {
+// WaitTimeout waits for all running async retries to complete or until the timeout
+// elapses. Returns true if all the retries completed in time. If the timeout elapses
+// the retries continue to run, callers may use `Stop()` to abort them.
+func (s *Async) WaitTimeout(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
 
-	// does this key have an existing retry running?
+// Close cancels the context of all running async retries and prevents new retries from starting,
+// once closed `Async()` returns an item with Err `ErrAsyncClosed`. Close waits up to `timeout` for the
+// running retries to exit, a timeout of zero waits until they have all exited. Returns false
+// if the timeout elapsed first. It is safe to call Close more than once.
+//
+// Close must not be called from the retried function or an `AsyncOptions` callback, Close waits
+// for the goroutine running the callback to exit and can only return false once the timeout
+// elapses, with a timeout of zero it never returns.
+func (s *Async) Close(timeout time.Duration) bool {
 	s.mutex.Lock()
-	if async, ok := s.asyncs[key]; ok {
-		// Remove entries that are no longer re-trying
-		if !async.Retrying {
-			delete(s.asyncs, key)
+	s.closed = true
+	s.asyncs = make(map[interface{}]AsyncItem)
+	s.times = make(map[interface{}]asyncTimes)
+	// Interrupt attempts which are blocked on their context, not just retries sleeping between attempts
+	for _, c := range s.cancels {
+		c.cancel()
+	}
+	s.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Stop()
+		close(done)
+	}()
+
+	if timeout == 0 {
+		<-done
+		return true
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (s *Async) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+// set records the state of an async retry unless the async has been closed
+func (s *Async) set(key interface{}, async AsyncItem) {
+	now := s.opts.Clock.Now()
+	s.mutex.Lock()
+	if !s.closed {
+		s.asyncs[key] = async
+		if t, ok := s.times[key]; ok && !async.Retrying && t.finished.IsZero() {
+			t.finished = now
+			s.times[key] = t
 		}
-		s.mutex.Unlock()
-		return &async
 	}
 	s.mutex.Unlock()
+}
+
+func (s *Async) Async(key interface{}, ctx context.Context, bo BackOff,
+	f func(context.Context, int) error) *AsyncItem {
+
+	// does this key have an existing retry running?
+	if async, ok := s.existing(key); ok {
+		return async
+	}
 
 	// Attempt to run the function, if successful return nil
 	err := f(s.ctx, 0)
 	if err == nil {
 		return nil
 	}
+	s.onAttempt(key, 0, err)
 
 	async := AsyncItem{
 		Retrying: true,
 		Err:      err,
 	}
+	s.start(key, ctx, 0, bo, f, async)
+	return &async
+}
+
+// AsyncDelayed behaves like `Async()` except no attempt is made until `delay` has elapsed,
+// the first attempt is made in the background instead of by the caller. The returned item
+// reports `Retrying` with no attempts while waiting for the delay. If the context is cancelled
+// or the key is cancelled via `Cancel()` during the delay no attempt is made.
+func (s *Async) AsyncDelayed(key interface{}, ctx context.Context, delay time.Duration, bo BackOff,
+	f func(context.Context, int) error) *AsyncItem {
+
+	if async, ok := s.existing(key); ok {
+		return async
+	}
 
+	async := AsyncItem{Retrying: true}
+	s.start(key, ctx, delay, bo, f, async)
+	return &async
+}
+
+// Cancel cancels the context of the running async retry for `key`, the retry stops
+// and the final state of the retry is returned by the next call to `Async()` or `Errs()`.
+// The Err of the final state is a `*retry.Err` with Reason `retry.CallerCancelled` which
+// wraps the last error of the retry, or `context.Canceled` if no attempt was made.
+// Returns false if no retry for the key is running.
+func (s *Async) Cancel(key interface{}) bool {
 	s.mutex.Lock()
-	s.asyncs[key] = async
+	c, ok := s.cancels[key]
+	if ok {
+		c.byCaller = true
+	}
 	s.mutex.Unlock()
+	if ok {
+		c.cancel()
+	}
+	return ok
+}
+
+// Get returns the current state of the retry for `key` without starting a retry
+// or removing a finished retry. Returns false if no retry for the key exists.
+func (s *Async) Get(key interface{}) (*AsyncItem, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	async, ok := s.asyncs[key]
+	if !ok {
+		return nil, false
+	}
+	return &async, true
+}
+
+// existing returns the state of the retry for `key` if one exists or the async is closed
+func (s *Async) existing(key interface{}) (*AsyncItem, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return &AsyncItem{Err: ErrAsyncClosed}, true
+	}
+	if async, ok := s.asyncs[key]; ok {
+		// Remove entries that are no longer re-trying
+		if !async.Retrying {
+			delete(s.asyncs, key)
+			delete(s.times, key)
+		}
+		return &async, true
+	}
+	return nil, false
+}
+
+// asyncCancel is a pointer such that a finished retry only removes its own
+// cancel func and never that of a newer retry with the same key
+type asyncCancel struct {
+	cancel context.CancelFunc
+	// byCaller is true if the retry was cancelled via `Cancel()`, protected by the mutex of Async
+	byCaller bool
+}
+
+// start runs the retry for `key` in the background after waiting for `delay`
+func (s *Async) start(key interface{}, ctx context.Context, delay time.Duration, bo BackOff,
+	f func(context.Context, int) error, async AsyncItem) {
+
+	ctx, cancel := context.WithCancel(ctx)
+	c := &asyncCancel{cancel: cancel}
+	now := s.opts.Clock.Now()
+	s.mutex.Lock()
+	s.cancels[key] = c
+	s.times[key] = asyncTimes{started: now}
+	s.mutex.Unlock()
+
+	s.set(key, async)
+	if s.opts.OnStart != nil {
+		s.opts.OnStart(key)
+	}
 
 	// Create an go routine to run the retry
 	s.wg.Until(func(done chan struct{}) bool {
 		//var start = time.Now()
-		async := AsyncItem{Retrying: true}
+		async := async
+		defer func() {
+			cancel()
+			s.mutex.Lock()
+			if s.cancels[key] == c {
+				delete(s.cancels, key)
+			}
+			s.mutex.Unlock()
+		}()
+		if s.opts.OnFinish != nil {
+			defer func() { s.opts.OnFinish(key, async.Err) }()
+		}
+
+		// cancelled records the final state of a retry whose context was cancelled
+		cancelled := func() {
+			async.Retrying = false
+			if async.Err == nil {
+				async.Err = ctx.Err()
+			}
+			s.mutex.Lock()
+			byCaller := c.byCaller
+			s.mutex.Unlock()
+			if byCaller {
+				async.Err = &Err{Reason: CallerCancelled, Attempts: async.Attempts, Err: async.Err}
+			}
+			s.set(key, async)
+		}
+
+		// sleep returns false if the retry should exit instead of making another attempt
+		sleep := func(interval time.Duration) bool {
+			timer := s.opts.Clock.NewTimer(interval)
+			select {
+			case <-timer.C():
+				timer.Stop()
+				return true
+			case <-ctx.Done():
+				cancelled()
+				timer.Stop()
+				return false
+			case <-done:
+				// immediate abort, abandon all work
+				if !timer.Stop() {
+					<-timer.C()
+				}
+				return false
+			}
+		}
+
+		if delay > 0 && !sleep(delay) {
+			return false
+		}
 
 		for {
+			// A retry started while closing must not outlive the close
+			if s.isClosed() {
+				return false
+			}
+
 			// Retry the function
 			async.Attempts++
 			async.Err = f(ctx, async.Attempts)
@@ -178,48 +811,84 @@ func (s *Async) Async(key interface{}, ctx context.Context, bo BackOff,
 			if async.Err == nil {
 				async.Retrying = false
 
-				s.mutex.Lock()
-				s.asyncs[key] = async
-				s.mutex.Unlock()
+				s.set(key, async)
 				return false
 			}
 
 			// Record the error and attempts
-			s.mutex.Lock()
-			s.asyncs[key] = async
-			s.mutex.Unlock()
+			s.set(key, async)
+			s.onAttempt(key, async.Attempts, async.Err)
+
+			// Don't consult the back off if we were cancelled during the attempt
+			if ctx.Err() != nil {
+				cancelled()
+				return false
+			}
 
 			interval, retry := bo.Next()
 			if !retry {
 				async.Retrying = false
-				s.mutex.Lock()
-				s.asyncs[key] = async
-				s.mutex.Unlock()
+				s.set(key, async)
 				return false
 			}
 
-			timer := time.NewTimer(interval)
-			select {
-			case <-timer.C:
-				timer.Stop()
-			case <-ctx.Done():
-				async.Retrying = false
-
-				s.mutex.Lock()
-				s.asyncs[key] = async
-				s.mutex.Unlock()
-				timer.Stop()
-				return false
-			case <-done:
-				// immediate abort, abandon all work
-				if !timer.Stop() {
-					<-timer.C
-				}
+			if !sleep(interval) {
 				return false
 			}
 		}
 	})
-	return &async
+}
+
+func (s *Async) onAttempt(key interface{}, attempt int, err error) {
+	if s.opts.OnAttempt != nil {
+		s.opts.OnAttempt(key, attempt, err)
+	}
+}
+
+// AsyncStatus is the state of an async retry returned by `Snapshot()`, it holds no
+// references to the internal state of the retry and is safe to encode as JSON
+type AsyncStatus struct {
+	Key      interface{} `json:"key"`
+	Retrying bool        `json:"retrying"`
+	Attempts int         `json:"attempts"`
+	// Err is the message of the last error or empty if the retry succeeded
+	Err string `json:"error,omitempty"`
+	// Running is the time since the retry started, or the time it ran for once it finished
+	Running time.Duration `json:"running"`
+}
+
+// Snapshot returns the status of every async retry, both running and finished retries which
+// were not yet collected via `Async()` or `Errs()`, ordered by the time they started. Unlike
+// `Errs()` it does not remove finished retries, which makes it suitable for a status endpoint.
+func (s *Async) Snapshot() []AsyncStatus {
+	now := s.opts.Clock.Now()
+	s.mutex.Lock()
+	statuses := make([]AsyncStatus, 0, len(s.asyncs))
+	started := make(map[interface{}]time.Time, len(s.asyncs))
+	for key, async := range s.asyncs {
+		status := AsyncStatus{Key: key, Retrying: async.Retrying, Attempts: async.Attempts}
+		if async.Err != nil {
+			status.Err = async.Err.Error()
+		}
+		t := s.times[key]
+		end := now
+		if !t.finished.IsZero() {
+			end = t.finished
+		}
+		status.Running = end.Sub(t.started)
+		started[key] = t.started
+		statuses = append(statuses, status)
+	}
+	s.mutex.Unlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		a, b := started[statuses[i].Key], started[statuses[j].Key]
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return fmt.Sprint(statuses[i].Key) < fmt.Sprint(statuses[j].Key)
+	})
+	return statuses
 }
 
 // Return errors from failed asyncs and clean up the internal async map
@@ -231,6 +900,7 @@ func (s *Async) Errs() map[interface{}]AsyncItem {
 		// Remove entries that are no longer re-trying
 		if !async.Retrying {
 			delete(s.asyncs, key)
+			delete(s.times, key)
 
 			// Only include async's that had an error
 			if async.Err != nil {
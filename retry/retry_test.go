@@ -2,11 +2,14 @@ package retry_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/mailgun/holster/v3/clock"
 	"github.com/mailgun/holster/v3/retry"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
@@ -59,6 +62,50 @@ func TestUntilAttempts(t *testing.T) {
 	assert.Equal(t, "on attempt '10'; attempts exhausted: failed attempt '10'", err.Error())
 }
 
+func TestUntilClockFrozen(t *testing.T) {
+	// Freezing the package clock does not stall retries using the default clock
+	clock.Freeze(clock.Now())
+	defer clock.Unfreeze()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- retry.Until(context.Background(), retry.Attempts(2, time.Millisecond), func(ctx context.Context, att int) error {
+			return errCause
+		})
+	}()
+
+	select {
+	case err := <-done:
+		var retryErr *retry.Err
+		require.True(t, errors.As(err, &retryErr))
+		assert.Equal(t, retry.AttemptsExhausted, retryErr.Reason)
+	case <-time.After(time.Second):
+		t.Fatal("retry stalled on the frozen clock")
+	}
+}
+
+func TestUntilAlreadyCancelled(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	for _, ctx := range []context.Context{cancelled, expired} {
+		var called bool
+		err := retry.Until(ctx, retry.Attempts(10, time.Millisecond), func(ctx context.Context, att int) error {
+			called = true
+			return nil
+		})
+		assert.False(t, called)
+
+		var retryErr *retry.Err
+		require.True(t, errors.As(err, &retryErr))
+		assert.Equal(t, retry.Cancelled, retryErr.Reason)
+		assert.Equal(t, 0, retryErr.Attempts)
+		assert.Equal(t, ctx.Err(), errors.Cause(err))
+	}
+}
+
 func TestUntilStopped(t *testing.T) {
 	ctx := context.Background()
 	err := retry.Until(ctx, retry.Attempts(10, time.Millisecond*10), func(ctx context.Context, att int) error {
@@ -70,9 +117,80 @@ func TestUntilStopped(t *testing.T) {
 	assert.True(t, errors.As(err, &retryErr))
 	assert.Equal(t, 1, retryErr.Attempts)
 	assert.Equal(t, retry.Stopped, retryErr.Reason)
+	assert.False(t, retryErr.Retried)
 	assert.Equal(t, "on attempt '1'; retry stopped: failed attempt '1'", err.Error())
 }
 
+func TestUntilStoppedAfterRetry(t *testing.T) {
+	ctx := context.Background()
+	err := retry.Until(ctx, retry.Attempts(10, time.Millisecond), func(ctx context.Context, att int) error {
+		if att == 3 {
+			return retry.Stop(fmt.Errorf("failed attempt '%d'", att))
+		}
+		return errCause
+	})
+	require.Error(t, err)
+	var retryErr *retry.Err
+	assert.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, 3, retryErr.Attempts)
+	assert.Equal(t, retry.Stopped, retryErr.Reason)
+	assert.True(t, retryErr.Retried)
+}
+
+func TestUntilSleep(t *testing.T) {
+	ctx := context.Background()
+	var calls []time.Time
+	err := retry.Until(ctx, retry.Attempts(3, time.Millisecond), func(ctx context.Context, att int) error {
+		calls = append(calls, time.Now())
+		switch att {
+		case 1:
+			// Reset time in the future
+			return retry.Sleep(time.Now().Add(time.Millisecond*50), errCause)
+		case 2:
+			// Reset time in the past
+			return retry.Sleep(time.Now().Add(-time.Hour), errCause)
+		}
+		return nil
+	})
+
+	require.NoError(t, err)
+	require.Len(t, calls, 3)
+	assert.True(t, calls[1].Sub(calls[0]) >= time.Millisecond*50)
+	assert.True(t, calls[2].Sub(calls[1]) < time.Millisecond*10)
+}
+
+func TestUntilSleepExhausted(t *testing.T) {
+	ctx := context.Background()
+	err := retry.Until(ctx, retry.Attempts(2, time.Millisecond), func(ctx context.Context, att int) error {
+		return retry.Sleep(time.Now(), errCause)
+	})
+
+	// Sleeping attempts count towards the back off
+	require.Error(t, err)
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, 2, retryErr.Attempts)
+	assert.Equal(t, retry.AttemptsExhausted, retryErr.Reason)
+	assert.Equal(t, errCause, errors.Cause(err))
+}
+
+func TestUntilSleepCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	start := time.Now()
+	err := retry.Until(ctx, retry.Interval(time.Millisecond), func(ctx context.Context, att int) error {
+		return retry.Sleep(time.Now().Add(time.Hour), errCause)
+	})
+
+	require.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, 1, retryErr.Attempts)
+	assert.Equal(t, retry.Cancelled, retryErr.Reason)
+}
+
 func TestUntilExponential(t *testing.T) {
 	ctx := context.Background()
 	backOff := &retry.ExponentialBackOff{
@@ -109,6 +227,195 @@ func TestUntilExponentialCancelled(t *testing.T) {
 	assert.Equal(t, "on attempt '6'; context cancelled: failed attempt '6'", err.Error())
 }
 
+func TestUntilFirstAttemptImmediate(t *testing.T) {
+	ctx := context.Background()
+	backOff := &retry.ExponentialBackOff{
+		Min:      time.Millisecond * 100,
+		Max:      time.Second,
+		Factor:   2,
+		Attempts: 1,
+	}
+
+	start := time.Now()
+	var calls []time.Duration
+	_ = retry.Until(ctx, backOff, func(ctx context.Context, att int) error {
+		calls = append(calls, time.Since(start))
+		return errCause
+	})
+
+	require.Len(t, calls, 2)
+	// The first attempt does not wait for the back off
+	assert.True(t, calls[0] < time.Millisecond*50, "first attempt was delayed by %s", calls[0])
+	// The first sleep is Min * Factor
+	assert.True(t, calls[1] >= time.Millisecond*200, "second attempt after %s", calls[1])
+}
+
+func TestUntilExponentialMaxElapsed(t *testing.T) {
+	ctx := context.Background()
+	// Attempts would allow many more tries, but elapsed cuts it short
+	backOff := &retry.ExponentialBackOff{
+		Min:        time.Millisecond * 10,
+		Max:        time.Millisecond * 10,
+		Factor:     1,
+		Attempts:   100,
+		MaxElapsed: time.Millisecond * 50,
+	}
+
+	err := retry.Until(ctx, backOff, func(ctx context.Context, att int) error {
+		return fmt.Errorf("failed attempt '%d'", att)
+	})
+
+	require.Error(t, err)
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, retry.Expired, retryErr.Reason)
+	assert.True(t, retryErr.Attempts < 100)
+	assert.True(t, backOff.Expired())
+}
+
+func TestUntilExponentialAttemptsBeforeElapsed(t *testing.T) {
+	ctx := context.Background()
+	// Elapsed would allow many more tries, but attempts cuts it short
+	backOff := &retry.ExponentialBackOff{
+		Min:        time.Millisecond,
+		Max:        time.Millisecond,
+		Factor:     1,
+		Attempts:   3,
+		MaxElapsed: time.Minute,
+	}
+
+	err := retry.Until(ctx, backOff, func(ctx context.Context, att int) error {
+		return fmt.Errorf("failed attempt '%d'", att)
+	})
+
+	require.Error(t, err)
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, retry.AttemptsExhausted, retryErr.Reason)
+	assert.Equal(t, 4, retryErr.Attempts)
+	assert.False(t, backOff.Expired())
+}
+
+func TestPollDone(t *testing.T) {
+	ctx := context.Background()
+	var calls int
+	err := retry.Poll(ctx, retry.Attempts(10, time.Millisecond), func(ctx context.Context, att int) (bool, error) {
+		calls++
+		return att == 3, nil
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls)
+}
+
+func TestPollError(t *testing.T) {
+	ctx := context.Background()
+	err := retry.Poll(ctx, retry.Attempts(10, time.Millisecond), func(ctx context.Context, att int) (bool, error) {
+		if att == 2 {
+			return false, errCause
+		}
+		return false, nil
+	})
+
+	require.Error(t, err)
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, 2, retryErr.Attempts)
+	assert.Equal(t, retry.Stopped, retryErr.Reason)
+	assert.Equal(t, errCause, errors.Cause(err))
+}
+
+func TestPollNotDone(t *testing.T) {
+	ctx := context.Background()
+	err := retry.Poll(ctx, retry.Attempts(3, time.Millisecond), func(ctx context.Context, att int) (bool, error) {
+		return false, nil
+	})
+
+	require.Error(t, err)
+	assert.Equal(t, retry.ErrNotDone, errors.Cause(err))
+	assert.Equal(t, "on attempt '3'; attempts exhausted: condition not met", err.Error())
+}
+
+func TestUntilTrue(t *testing.T) {
+	// True after N attempts
+	var attempts int
+	err := retry.UntilTrue(context.Background(), retry.Attempts(10, time.Millisecond), func(ctx context.Context, att int) (bool, error) {
+		attempts = att
+		return att == 4, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 4, attempts)
+
+	// Immediately true never sleeps
+	start := time.Now()
+	err = retry.UntilTrue(context.Background(), retry.Attempts(10, time.Second), func(ctx context.Context, att int) (bool, error) {
+		attempts = att
+		return true, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, attempts)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestUntilTrueError(t *testing.T) {
+	var attempts int
+	err := retry.UntilTrue(context.Background(), retry.Attempts(10, time.Millisecond), func(ctx context.Context, att int) (bool, error) {
+		attempts = att
+		if att == 2 {
+			return false, errCause
+		}
+		return false, nil
+	})
+
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, retry.Stopped, retryErr.Reason)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, errCause, errors.Cause(err))
+}
+
+func TestUntilConsecutive(t *testing.T) {
+	// Fails on the 3rd attempt which resets the count of successes
+	var attempts int
+	err := retry.UntilConsecutive(context.Background(), retry.Attempts(10, time.Millisecond), 3, func(ctx context.Context, att int) error {
+		attempts = att
+		if att == 3 {
+			return errCause
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 6, attempts)
+}
+
+func TestUntilConsecutiveNotReached(t *testing.T) {
+	// Alternating success and failure never reaches two in a row
+	err := retry.UntilConsecutive(context.Background(), retry.Attempts(5, time.Millisecond), 2, func(ctx context.Context, att int) error {
+		if att%2 == 0 {
+			return errCause
+		}
+		return nil
+	})
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, retry.AttemptsExhausted, retryErr.Reason)
+	assert.Equal(t, 5, retryErr.Attempts)
+	assert.Equal(t, retry.ErrNotDone, retryErr.Err)
+}
+
+func TestUntilConsecutiveCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	err := retry.UntilConsecutive(ctx, retry.Interval(time.Millisecond*10), 100, func(ctx context.Context, att int) error {
+		return nil
+	})
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, retry.Cancelled, retryErr.Reason)
+	assert.Equal(t, retry.ErrNotDone, retryErr.Err)
+}
+
 func TestAsync(t *testing.T) {
 	ctx := context.Background()
 	async := retry.NewRetryAsync()
@@ -143,6 +450,410 @@ func TestAsync(t *testing.T) {
 	async.Wait()
 }
 
+func TestAsyncOnAttempt(t *testing.T) {
+	var mutex sync.Mutex
+	attempts := make(map[interface{}][]int)
+
+	var async *retry.Async
+	async = retry.NewRetryAsync(retry.AsyncOptions{
+		OnAttempt: func(key interface{}, att int, err error) {
+			// Must not deadlock when calling back into async
+			async.Len()
+
+			assert.Equal(t, errCause, err)
+			mutex.Lock()
+			attempts[key] = append(attempts[key], att)
+			mutex.Unlock()
+		},
+	})
+
+	ctx := context.Background()
+	async.Async("one", ctx, retry.Attempts(3, time.Millisecond), func(ctx context.Context, i int) error { return errCause })
+	async.Async("two", ctx, retry.Attempts(2, time.Millisecond), func(ctx context.Context, i int) error { return errCause })
+	async.Wait()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []int{0, 1, 2, 3}, attempts["one"])
+	assert.Equal(t, []int{0, 1, 2}, attempts["two"])
+}
+
+func TestAsyncOnStartFinish(t *testing.T) {
+	var mutex sync.Mutex
+	started := make(map[interface{}]int)
+	finished := make(map[interface{}]int)
+	finalErr := make(map[interface{}]error)
+
+	var async *retry.Async
+	async = retry.NewRetryAsync(retry.AsyncOptions{
+		OnStart: func(key interface{}) {
+			// Must not deadlock when calling back into async
+			async.Len()
+			mutex.Lock()
+			started[key]++
+			mutex.Unlock()
+		},
+		OnFinish: func(key interface{}, err error) {
+			async.Len()
+			mutex.Lock()
+			finished[key]++
+			finalErr[key] = err
+			mutex.Unlock()
+		},
+	})
+
+	ctx := context.Background()
+	fail := func(ctx context.Context, i int) error { return errCause }
+	async.Async("one", ctx, retry.Attempts(10, time.Millisecond*10), fail)
+	async.Async("two", ctx, retry.Attempts(10, time.Millisecond*10), func(ctx context.Context, i int) error {
+		if i < 2 {
+			return errCause
+		}
+		return nil
+	})
+
+	// The second call for the same key returns the running retry and does not start another
+	f1 := async.Async("for", ctx, retry.Attempts(10, time.Millisecond*100), fail)
+	f2 := async.Async("for", ctx, retry.Attempts(10, time.Millisecond*100), fail)
+	assert.Equal(t, f1, f2)
+
+	// A function which succeeds on the first attempt never starts a retry
+	assert.Nil(t, async.Async("fiv", ctx, retry.Attempts(10, time.Millisecond), func(ctx context.Context, i int) error { return nil }))
+
+	async.Wait()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, map[interface{}]int{"one": 1, "two": 1, "for": 1}, started)
+	assert.Equal(t, map[interface{}]int{"one": 1, "two": 1, "for": 1}, finished)
+	assert.Equal(t, errCause, finalErr["one"])
+	assert.Nil(t, finalErr["two"])
+	assert.Equal(t, errCause, finalErr["for"])
+}
+
+func TestAsyncWaitTimeout(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	async := retry.NewRetryAsync()
+	for _, key := range []string{"one", "two"} {
+		async.Async(key, ctx, retry.Interval(time.Millisecond*10), func(ctx context.Context, i int) error {
+			if i == 0 {
+				return errCause
+			}
+			<-release
+			return nil
+		})
+	}
+
+	// The retries are blocked, the wait times out
+	assert.False(t, async.WaitTimeout(time.Millisecond*50))
+
+	// Once released the retries complete and a later wait returns in time
+	close(release)
+	assert.True(t, async.WaitTimeout(time.Second))
+
+	async = retry.NewRetryAsync()
+	async.Async("thr", ctx, retry.Attempts(2, time.Millisecond), func(ctx context.Context, i int) error { return errCause })
+	assert.True(t, async.WaitTimeout(time.Second))
+}
+
+func TestAsyncRace(t *testing.T) {
+	ctx := context.Background()
+	async := retry.NewRetryAsync()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				item := async.Async("key", ctx, retry.Attempts(20, time.Millisecond), func(ctx context.Context, i int) error {
+					return errCause
+				})
+				if item != nil {
+					_ = item.Err
+					_ = item.Attempts
+				}
+				for _, e := range async.Errs() {
+					_ = e.Err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	async.Wait()
+}
+
+func TestAsyncClose(t *testing.T) {
+	ctx := context.Background()
+	async := retry.NewRetryAsync()
+	for _, key := range []string{"one", "two", "thr"} {
+		async.Async(key, ctx, retry.Interval(time.Millisecond*10), func(ctx context.Context, i int) error { return errCause })
+	}
+	time.Sleep(time.Millisecond * 20)
+	assert.Equal(t, 3, async.Len())
+
+	// Close while the retries are mid-flight
+	assert.True(t, async.Close(time.Second))
+	assert.Equal(t, 0, async.Len())
+
+	// No new retries are started once closed
+	var called bool
+	item := async.Async("for", ctx, retry.Interval(time.Millisecond), func(ctx context.Context, i int) error {
+		called = true
+		return errCause
+	})
+	require.NotNil(t, item)
+	assert.False(t, called)
+	assert.False(t, item.Retrying)
+	assert.Equal(t, retry.ErrAsyncClosed, item.Err)
+	assert.Equal(t, 0, async.Len())
+
+	// Close is idempotent
+	assert.True(t, async.Close(0))
+
+	// Close interrupts an attempt which is blocked on its context
+	async = retry.NewRetryAsync()
+	async.Async("blocked", ctx, retry.Interval(time.Millisecond), func(ctx context.Context, i int) error {
+		if i == 0 {
+			return errCause
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	time.Sleep(time.Millisecond * 20)
+	start := time.Now()
+	assert.True(t, async.Close(time.Second))
+	assert.True(t, time.Since(start) < time.Millisecond*500)
+}
+
+func TestAsyncCloseFromCallback(t *testing.T) {
+	var async *retry.Async
+	closed := make(chan bool, 1)
+	async = retry.NewRetryAsync(retry.AsyncOptions{
+		OnFinish: func(key interface{}, err error) {
+			closed <- async.Close(time.Millisecond * 50)
+		},
+	})
+	async.Async("one", context.Background(), retry.Attempts(1, time.Millisecond), func(ctx context.Context, i int) error {
+		return errCause
+	})
+
+	// Close waits for the goroutine running the callback, it can only time out
+	assert.False(t, <-closed)
+
+	// Once the callback returns the retry exits, a later Close only completes
+	// if the stop started by the first Close did not leak
+	assert.True(t, async.Close(time.Second))
+}
+
+func TestAsyncClock(t *testing.T) {
+	// The intervals are only ever reached via the injected clock, never in real time
+	fc := retry.NewFakeClock(time.Now())
+	var one, two int32
+	ctx := context.Background()
+	async := retry.NewRetryAsync(retry.AsyncOptions{Clock: fc})
+	async.Async("one", ctx, retry.Interval(time.Hour), func(ctx context.Context, i int) error {
+		atomic.AddInt32(&one, 1)
+		return errCause
+	})
+	async.Async("two", ctx, retry.Interval(time.Hour*2), func(ctx context.Context, i int) error {
+		atomic.AddInt32(&two, 1)
+		return errCause
+	})
+	defer async.Stop()
+
+	// Both retries made their initial attempt and the first retry, then wait on the clock
+	require.True(t, fc.Wait4Scheduled(2, time.Second))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&one))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&two))
+
+	// Only "one" is due after an hour
+	fc.Advance(time.Hour)
+	require.True(t, fc.Wait4Scheduled(2, time.Second))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&one))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&two))
+
+	// Both are due after another hour
+	fc.Advance(time.Hour)
+	require.True(t, fc.Wait4Scheduled(2, time.Second))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&one))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&two))
+}
+
+func TestAsyncDelayed(t *testing.T) {
+	fc := retry.NewFakeClock(time.Now())
+	async := retry.NewRetryAsync(retry.AsyncOptions{Clock: fc})
+
+	var mutex sync.Mutex
+	var calledAt []time.Time
+	start := fc.Now()
+	item := async.AsyncDelayed("one", context.Background(), time.Second*30, retry.Attempts(3, time.Second),
+		func(ctx context.Context, att int) error {
+			mutex.Lock()
+			calledAt = append(calledAt, fc.Now())
+			mutex.Unlock()
+			if att < 2 {
+				return errCause
+			}
+			return nil
+		})
+
+	// Retrying during the delay without any attempts
+	require.NotNil(t, item)
+	assert.True(t, item.Retrying)
+	assert.Equal(t, 0, item.Attempts)
+	assert.Nil(t, item.Err)
+
+	// Nothing is attempted until the delay elapses
+	require.True(t, fc.Wait4Scheduled(1, time.Second))
+	fc.Advance(time.Second * 29)
+	mutex.Lock()
+	assert.Empty(t, calledAt)
+	mutex.Unlock()
+
+	fc.Advance(time.Second)
+	require.True(t, fc.Wait4Scheduled(1, time.Second))
+	fc.Advance(time.Second)
+	async.Wait()
+
+	assert.Equal(t, []time.Time{start.Add(time.Second * 30), start.Add(time.Second * 31)}, calledAt)
+	// The final state is returned without calling the function again
+	item = async.Async("one", context.Background(), retry.Attempts(3, time.Second), nil)
+	assert.False(t, item.Retrying)
+	assert.Equal(t, 2, item.Attempts)
+	assert.Nil(t, item.Err)
+}
+
+func TestAsyncDelayedCancel(t *testing.T) {
+	fc := retry.NewFakeClock(time.Now())
+	async := retry.NewRetryAsync(retry.AsyncOptions{Clock: fc})
+
+	var called int32
+	async.AsyncDelayed("one", context.Background(), time.Second*30, retry.Attempts(3, time.Second),
+		func(ctx context.Context, att int) error {
+			atomic.AddInt32(&called, 1)
+			return nil
+		})
+	require.True(t, fc.Wait4Scheduled(1, time.Second))
+
+	// Cancelling the key during the delay prevents the first attempt
+	assert.True(t, async.Cancel("one"))
+	async.Wait()
+	fc.Advance(time.Minute)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&called))
+
+	errs := async.Errs()
+	require.Contains(t, errs, "one")
+	assert.False(t, errs["one"].Retrying)
+	var retryErr *retry.Err
+	require.True(t, errors.As(errs["one"].Err, &retryErr))
+	assert.Equal(t, retry.CallerCancelled, retryErr.Reason)
+	assert.Equal(t, 0, retryErr.Attempts)
+	assert.Equal(t, context.Canceled, errors.Cause(retryErr))
+
+	// The retry is gone once it has exited
+	assert.False(t, async.Cancel("one"))
+}
+
+func TestAsyncCancel(t *testing.T) {
+	async := retry.NewRetryAsync()
+	async.Async("one", context.Background(), retry.Interval(time.Millisecond*10), func(ctx context.Context, i int) error {
+		return errCause
+	})
+	async.Async("two", context.Background(), retry.Attempts(3, time.Millisecond*10), func(ctx context.Context, i int) error {
+		return errCause
+	})
+
+	// Only the cancelled key stops, the last error of the retry is kept
+	assert.True(t, async.Cancel("one"))
+	async.Wait()
+
+	// The cancelled retry reports it was stopped by the caller
+	item, ok := async.Get("one")
+	require.True(t, ok)
+	assert.False(t, item.Retrying)
+	var retryErr *retry.Err
+	require.True(t, errors.As(item.Err, &retryErr))
+	assert.Equal(t, retry.CallerCancelled, retryErr.Reason)
+	assert.Equal(t, item.Attempts, retryErr.Attempts)
+	assert.Equal(t, errCause, errors.Cause(item.Err))
+
+	// The retry which ran to completion reports its last error
+	item, ok = async.Get("two")
+	require.True(t, ok)
+	assert.False(t, item.Retrying)
+	assert.Equal(t, 3, item.Attempts)
+	assert.Equal(t, errCause, item.Err)
+
+	// Get does not remove finished retries
+	_, ok = async.Get("one")
+	assert.True(t, ok)
+	_, ok = async.Get("unknown")
+	assert.False(t, ok)
+}
+
+func TestAsyncCancelDuringLastAttempt(t *testing.T) {
+	async := retry.NewRetryAsync()
+	running := make(chan struct{})
+	async.Async("one", context.Background(), retry.Attempts(1, time.Millisecond), func(ctx context.Context, i int) error {
+		if i == 0 {
+			return errCause
+		}
+		close(running)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	// Cancelled while the final attempt is running, before the back off is exhausted
+	<-running
+	assert.True(t, async.Cancel("one"))
+	async.Wait()
+
+	item, ok := async.Get("one")
+	require.True(t, ok)
+	assert.False(t, item.Retrying)
+	assert.Equal(t, 1, item.Attempts)
+	var retryErr *retry.Err
+	require.True(t, errors.As(item.Err, &retryErr))
+	assert.Equal(t, retry.CallerCancelled, retryErr.Reason)
+	assert.Equal(t, context.Canceled, errors.Cause(item.Err))
+}
+
+func TestAsyncSnapshot(t *testing.T) {
+	fc := retry.NewFakeClock(time.Now())
+	async := retry.NewRetryAsync(retry.AsyncOptions{Clock: fc})
+	defer async.Stop()
+
+	fail := func(ctx context.Context, i int) error { return errCause }
+	async.Async("one", context.Background(), retry.Interval(time.Hour), fail)
+	async.Async("two", context.Background(), retry.Attempts(2, time.Second), fail)
+	require.True(t, fc.Wait4Scheduled(2, time.Second))
+
+	// The second retry exhausts its attempts while the first keeps running
+	fc.Advance(time.Second)
+	require.Eventually(t, func() bool {
+		item, ok := async.Get("two")
+		return ok && !item.Retrying
+	}, time.Second, time.Millisecond)
+	fc.Advance(time.Second * 9)
+
+	snapshot := async.Snapshot()
+	assert.Equal(t, []retry.AsyncStatus{
+		{Key: "one", Retrying: true, Attempts: 1, Err: "cause of error", Running: time.Second * 10},
+		{Key: "two", Retrying: false, Attempts: 2, Err: "cause of error", Running: time.Second},
+	}, snapshot)
+
+	b, err := json.Marshal(snapshot)
+	require.NoError(t, err)
+	assert.Equal(t, `[{"key":"one","retrying":true,"attempts":1,"error":"cause of error","running":10000000000},`+
+		`{"key":"two","retrying":false,"attempts":2,"error":"cause of error","running":1000000000}]`, string(b))
+
+	// Snapshot does not remove finished retries
+	assert.Len(t, async.Snapshot(), 2)
+	assert.Equal(t, 2, async.Len())
+}
+
 func TestBackoffRace(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
 	defer cancel()
@@ -175,3 +886,109 @@ func TestBackOffNew(t *testing.T) {
 	bo := backOff.New()
 	assert.Equal(t, bo, backOff)
 }
+
+func TestErrClone(t *testing.T) {
+	err := &retry.Err{Err: errCause, Reason: retry.Cancelled, Attempts: 3}
+	c := err.Clone()
+	assert.Equal(t, err, c)
+
+	c.Attempts = 5
+	c.Reason = retry.Stopped
+	assert.Equal(t, 3, err.Attempts)
+	assert.Equal(t, retry.Cancelled, err.Reason)
+}
+
+func TestErrMarshalJSON(t *testing.T) {
+	for _, tt := range []struct {
+		err      *retry.Err
+		expected string
+	}{
+		{
+			err:      &retry.Err{Err: errCause, Reason: retry.Cancelled, Attempts: 19},
+			expected: `{"attempts":19,"reason":"context cancelled","cause":"cause of error"}`,
+		},
+		{
+			err:      &retry.Err{Err: errCause, Reason: retry.Stopped, Attempts: 1},
+			expected: `{"attempts":1,"reason":"retry stopped","cause":"cause of error"}`,
+		},
+		{
+			err:      &retry.Err{Err: errCause, Reason: retry.AttemptsExhausted, Attempts: 10},
+			expected: `{"attempts":10,"reason":"attempts exhausted","cause":"cause of error"}`,
+		},
+		{
+			err:      &retry.Err{Err: errCause, Reason: retry.Expired, Attempts: 5},
+			expected: `{"attempts":5,"reason":"max elapsed time exceeded","cause":"cause of error"}`,
+		},
+		{
+			err:      &retry.Err{Err: retry.ErrMisconfigured, Reason: retry.Misconfigured},
+			expected: `{"attempts":0,"reason":"misconfigured","cause":"misconfigured back off"}`,
+		},
+		{
+			err:      &retry.Err{Name: "fetch-user", Err: errCause, Reason: retry.Cancelled, Attempts: 2},
+			expected: `{"name":"fetch-user","attempts":2,"reason":"context cancelled","cause":"cause of error"}`,
+		},
+	} {
+		t.Run(tt.err.Reason.String(), func(t *testing.T) {
+			b, err := json.Marshal(tt.err)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, string(b))
+		})
+	}
+}
+
+func TestErrEqual(t *testing.T) {
+	got := &retry.Err{Name: "op", Err: errors.Wrap(errCause, "while fetching"), Reason: retry.Cancelled, Attempts: 19, Retried: true}
+
+	assert.True(t, got.Equal(&retry.Err{Reason: retry.Cancelled, Attempts: 19}))
+	assert.True(t, got.Equal(&retry.Err{Reason: retry.Cancelled, Attempts: 19, Err: errCause}))
+	assert.False(t, got.Equal(&retry.Err{Reason: retry.Cancelled, Attempts: 19, Err: retry.ErrNotDone}))
+	assert.False(t, got.Equal(&retry.Err{Reason: retry.Cancelled, Attempts: 18}))
+	assert.False(t, got.Equal(&retry.Err{Reason: retry.Stopped, Attempts: 19}))
+	assert.False(t, got.Equal(nil))
+}
+
+func TestErrIs(t *testing.T) {
+	err := retry.Until(context.Background(), retry.Attempts(3, time.Millisecond), func(ctx context.Context, att int) error {
+		return errCause
+	})
+	require.Error(t, err)
+
+	// Zero fields match anything
+	assert.True(t, errors.Is(err, &retry.Err{}))
+	assert.True(t, errors.Is(err, &retry.Err{Reason: retry.AttemptsExhausted}))
+	assert.True(t, errors.Is(err, &retry.Err{Attempts: 3}))
+	assert.True(t, errors.Is(err, &retry.Err{Reason: retry.AttemptsExhausted, Attempts: 3}))
+	assert.True(t, errors.Is(err, errCause))
+
+	assert.False(t, errors.Is(err, &retry.Err{Reason: retry.Cancelled}))
+	assert.False(t, errors.Is(err, &retry.Err{Reason: retry.AttemptsExhausted, Attempts: 2}))
+
+	// A typed nil target never matches
+	assert.False(t, errors.Is(err, (*retry.Err)(nil)))
+}
+
+func TestErrs(t *testing.T) {
+	errA := errors.New("endpoint a down")
+	errs := retry.Errs{
+		{Err: errA, Reason: retry.AttemptsExhausted, Attempts: 3},
+		{Err: errCause, Reason: retry.Cancelled, Attempts: 2},
+	}
+	var err error = errs
+
+	assert.Equal(t, "2 retries failed: "+
+		"on attempt '3'; attempts exhausted: endpoint a down; "+
+		"on attempt '2'; context cancelled: cause of error", err.Error())
+
+	// Both errors and their causes are discoverable
+	assert.True(t, errors.Is(err, &retry.Err{}))
+	assert.True(t, errors.Is(err, &retry.Err{Reason: retry.Cancelled, Attempts: 2}))
+	assert.False(t, errors.Is(err, &retry.Err{Reason: retry.Stopped}))
+	assert.True(t, errors.Is(err, errA))
+	assert.True(t, errors.Is(err, errCause))
+
+	var retryErr *retry.Err
+	require.True(t, errors.As(err, &retryErr))
+	assert.Equal(t, errA, retryErr.Err)
+
+	assert.Equal(t, []error{errs[0], errs[1]}, errs.Unwrap())
+}